@@ -1,22 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/gin-gonic/gin"
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/parser"
 )
 
 type discordInteractionRequest struct {
-	Type int             `json:"type"`
-	Data json.RawMessage `json:"data,omitempty"`
+	ID            string          `json:"id"`
+	ApplicationID string          `json:"application_id"`
+	Type          int             `json:"type"`
+	GuildID       string          `json:"guild_id,omitempty"`
+	Data          json.RawMessage `json:"data,omitempty"`
+	Token         string          `json:"token"`
 }
 
 const (
@@ -32,6 +44,20 @@ type discordInteractionRequestApplicationCommandData struct {
 	Options []discordInteractionRequestApplicationCommandOption `json:"options,omitempty"`
 }
 
+func (command *discordInteractionRequestApplicationCommandData) getBoolOption(name string) bool {
+	for _, option := range command.Options {
+		if option.Name != name {
+			continue
+		}
+
+		value, _ := option.Value.(bool)
+
+		return value
+	}
+
+	return false
+}
+
 func (command *discordInteractionRequestApplicationCommandData) getStringOption(name string) string {
 	for _, option := range command.Options {
 		if option.Name != name {
@@ -65,6 +91,9 @@ const (
 	discordInteractionResponsePremiumRequired                      = 10
 )
 
+// Discord rejects messages longer than this many characters.
+const discordMessageLimit = 2000
+
 type discordInteractionResponseMessageData struct {
 	Content string `json:"content,omitempty"`
 }
@@ -151,19 +180,191 @@ func discordHandleInteractionRequestApplicationCommand(ctx *gin.Context, request
 
 	switch command.Name {
 	case "roll":
-		ctx.JSON(http.StatusOK, discordHandleCommandRoll(&command))
+		discordHandleCommandRoll(ctx, request, &command)
 	default:
 		ctx.String(http.StatusBadRequest, "unrecognized command: %v", command.Name)
 	}
 }
 
-func discordHandleCommandRoll(command *discordInteractionRequestApplicationCommandData) *discordInteractionResponse {
-	return &discordInteractionResponse{
-		Type: discordInteractionResponseChannelMessageWithSource,
-		Data: discordInteractionResponseMessageData{
-			Content: roll(command.getStringOption("formula")),
-		},
+const (
+	// Discord drops interactions that are not responded to within three
+	// seconds of being created.
+	discordResponseTimeout = 3 * time.Second
+	// Leave time for the response to reach Discord.
+	discordResponseMargin = 500 * time.Millisecond
+	// Rolls that miss the response timeout are deferred and given until
+	// this long after the interaction was created to finish.
+	discordRollTimeout = 10 * time.Second
+)
+
+func discordHandleCommandRoll(
+	ctx *gin.Context,
+	request *discordInteractionRequest,
+	command *discordInteractionRequestApplicationCommandData,
+) {
+	created := discordInteractionCreated(request.ID)
+
+	// The roll outlives this request when it is deferred.
+	rollCtx, cancel := context.WithDeadline(context.Background(), created.Add(discordRollTimeout))
+	contents := make(chan string, 1)
+
+	formula := command.getStringOption("formula")
+
+	go func() {
+		defer cancel()
+
+		// Gin no longer recovers from panics once the roll leaves the
+		// request, so recover here rather than crash the bot.
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				log.Printf("panic while rolling %q: %v\n%s", formula, recovered, debug.Stack())
+
+				contents <- fmt.Sprintf("**Rolling**: %v\n**Error**: %v", discordEscapeMarkdown(formula), rollPanicMessage)
+			}
+		}()
+
+		contents <- roll(rollCtx, formula, discordRollOptions(request, command))
+	}()
+
+	timer := time.NewTimer(time.Until(created.Add(discordResponseTimeout - discordResponseMargin)))
+	defer timer.Stop()
+
+	select {
+	case content := <-contents:
+		ctx.JSON(http.StatusOK, &discordInteractionResponse{
+			Type: discordInteractionResponseChannelMessageWithSource,
+			Data: discordInteractionResponseMessageData{Content: content},
+		})
+	case <-timer.C:
+		ctx.JSON(http.StatusOK, &discordInteractionResponse{
+			Type: discordInteractionResponseDeferredChannelMessageWithSource,
+			Data: nil,
+		})
+
+		go func() {
+			if err := discordEditOriginalResponse(request, <-contents); err != nil {
+				log.Printf("failed to edit deferred response: %v", err)
+			}
+		}()
+	}
+}
+
+// Read the options of /roll other than the formula.
+func discordRollOptions(
+	request *discordInteractionRequest,
+	command *discordInteractionRequestApplicationCommandData,
+) rollOptions {
+	options := rollOptions{
+		explain:      command.getBoolOption("explain"),
+		mode:         ast.Random,
+		rounding:     ast.RoundDown,
+		dialect:      discordGuildDialect(request.GuildID),
+		advantage:    command.getBoolOption("advantage"),
+		disadvantage: command.getBoolOption("disadvantage"),
+	}
+
+	if dialect, isDialect := parser.DialectNamed(command.getStringOption("dialect")); isDialect {
+		options.dialect = dialect
+	}
+
+	// These are the choices of the mode option in commands.json.
+	switch command.getStringOption("mode") {
+	case "average":
+		options.mode = ast.Average
+	case "average-up":
+		options.mode, options.rounding = ast.Average, ast.RoundUp
+	case "average-nearest":
+		options.mode, options.rounding = ast.Average, ast.RoundNearest
+	case "maximum":
+		options.mode = ast.Maximum
+	case "minimum":
+		options.mode = ast.Minimum
+	}
+
+	return options
+}
+
+// Return the dialect that a guild reads formulas in by default, which is set
+// in the environment variable DISCORD_GUILD_DIALECTS as a list of guild IDs and
+// dialect names such as "1234=roll20,5678=avrae".
+func discordGuildDialect(guildID string) parser.Dialect {
+	for _, entry := range strings.Split(os.Getenv("DISCORD_GUILD_DIALECTS"), ",") {
+		id, name, isCut := strings.Cut(strings.TrimSpace(entry), "=")
+		if !isCut || id != guildID || guildID == "" {
+			continue
+		}
+
+		dialect, isDialect := parser.DialectNamed(name)
+		if !isDialect {
+			log.Printf("unrecognized dialect %q for guild %v in DISCORD_GUILD_DIALECTS", name, guildID)
+		}
+
+		return dialect
+	}
+
+	return parser.Native
+}
+
+// Return when an interaction was created from the timestamp in its snowflake
+// ID. Times that cannot be right because of a bad ID or clock skew are moved
+// into the window in which Discord still accepts a response.
+func discordInteractionCreated(id string) time.Time {
+	const (
+		discordEpoch    = 1420070400000
+		timestampOffset = 22
+	)
+
+	now := time.Now()
+
+	snowflake, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return now
+	}
+
+	created := time.UnixMilli(int64(snowflake>>timestampOffset) + discordEpoch)
+
+	switch {
+	case created.After(now):
+		return now
+	case created.Before(now.Add(-discordResponseTimeout)):
+		return now.Add(-discordResponseTimeout)
+	default:
+		return created
+	}
+}
+
+var discordClient = &http.Client{Timeout: 10 * time.Second} //nolint:gomnd
+
+// Replace the content of the response to an interaction, such as after
+// deferring it.
+func discordEditOriginalResponse(request *discordInteractionRequest, content string) error {
+	body, err := json.Marshal(discordInteractionResponseMessageData{Content: content})
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	endpoint := fmt.Sprintf("https://discord.com/api/v10/webhooks/%v/%v/messages/@original",
+		url.PathEscape(request.ApplicationID), url.PathEscape(request.Token))
+
+	httpRequest, err := http.NewRequestWithContext(context.Background(), http.MethodPatch, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
 	}
+
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	response, err := discordClient.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %v", response.Status) //nolint:goerr113
+	}
+
+	return nil
 }
 
 func discordEscapeMarkdown(input string) string {
@@ -192,3 +393,9 @@ func discordEscapeMarkdown(input string) string {
 
 	return output.String()
 }
+
+func discordCodeBlock(input string) string {
+	// Nothing inside a code block is Markdown, but a "```" would end the
+	// block early. Break up runs of backticks with zero width spaces.
+	return "```\n" + strings.ReplaceAll(input, "`", "`\u200b") + "\n```"
+}
@@ -1,15 +1,28 @@
 package ast
 
-// We use a non-crypto rand since dice bots are a terrible option for cryptography anyway.
-import "math/rand"
+import (
+	"fmt"
+	"math"
+	"math/big"
+
+	// We use a non-crypto rand since dice bots are a terrible option for cryptography anyway.
+	"math/rand"
+
+	"meganruggiero.com/dicebot/internal/token"
+)
 
 type Formula struct {
-	Equations []Equation
+	Equations []Equation `json:"equations"`
 }
 
 type Equation struct {
 	Name string
 	Term Term
+	Span token.Span
+	// Ordinal is the position of the equation in the formula as it was
+	// written, counting from 1 and including equations that failed to
+	// parse, or 0 if unknown.
+	Ordinal int
 }
 
 type TermKind int
@@ -21,47 +34,464 @@ const (
 	Subtract
 )
 
-type Term interface{ Solve() int }
+// Term is a node of a formula. Evaluate reports errors such as division by
+// zero or exceeded limits, while Solve panics on them like native arithmetic.
+// Source returns the part of the input the term was parsed from, which is zero
+// for terms built by hand, and String prints the term the way it would be typed.
+type Term interface {
+	Solve() int
+	Source() token.Span
+	String() string
+	Evaluate(evaluator *Evaluator) (int, error)
+}
+
+func solve(term Term) int {
+	value, err := term.Evaluate(NewEvaluator())
+	if err != nil {
+		panic(err)
+	}
 
-type MultiplyTerm struct{ Left, Right Term }
+	return value
+}
+
+type Comparison int
+
+const (
+	Equal Comparison = iota
+	NotEqual
+	Less
+	LessEqual
+	Greater
+	GreaterEqual
+)
 
-func (mulTerm MultiplyTerm) Solve() int {
-	return mulTerm.Left.Solve() * mulTerm.Right.Solve()
+// CompareTerm solves to 1 when the comparison holds and 0 otherwise.
+type CompareTerm struct {
+	Comparison  Comparison
+	Left, Right Term
+	Span        token.Span
 }
 
-type DivideTerm struct{ Left, Right Term }
+func (cmpTerm CompareTerm) Solve() int { return solve(cmpTerm) }
 
-func (divTerm DivideTerm) Solve() int {
-	return divTerm.Left.Solve() / divTerm.Right.Solve()
+func (cmpTerm CompareTerm) Source() token.Span { return cmpTerm.Span }
+
+func (cmpTerm CompareTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	left, right, err := evaluateBoth(evaluator, cmpTerm.Left, cmpTerm.Right)
+	if err != nil {
+		return 0, err
+	}
+
+	value := 0
+	if cmpTerm.Comparison.Compare(left, right) {
+		value = 1
+	}
+
+	if evaluator.Trace {
+		evaluator.traceOperation(cmpTerm, left, cmpTerm.Comparison.String(), right, value)
+	}
+
+	return value, nil
 }
 
-type AddTerm struct{ Left, Right Term }
+// Compare reports whether left and right satisfy the comparison.
+func (comparison Comparison) Compare(left, right int) bool {
+	switch comparison {
+	case Equal:
+		return left == right
+	case NotEqual:
+		return left != right
+	case Less:
+		return left < right
+	case LessEqual:
+		return left <= right
+	case Greater:
+		return left > right
+	case GreaterEqual:
+		return left >= right
+	default:
+		return false
+	}
+}
 
-func (addTerm AddTerm) Solve() int {
-	return addTerm.Left.Solve() + addTerm.Right.Solve()
+// ConditionalTerm only solves the branch selected by its condition so that the
+// other branch's dice are never rolled.
+type ConditionalTerm struct {
+	Condition, Then, Else Term
+	Span                  token.Span
 }
 
-type SubtractTerm struct{ Left, Right Term }
+func (condTerm ConditionalTerm) Solve() int { return solve(condTerm) }
+
+func (condTerm ConditionalTerm) Source() token.Span { return condTerm.Span }
+
+func (condTerm ConditionalTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	condition, err := condTerm.Condition.Evaluate(evaluator)
+	if err != nil {
+		return 0, err
+	}
+
+	branch := condTerm.Else
+	if condition != 0 {
+		branch = condTerm.Then
+	}
+
+	value, err := branch.Evaluate(evaluator)
+	if err != nil {
+		return 0, err
+	}
+
+	if evaluator.Trace {
+		evaluator.traceBranch(condTerm, condition, condition != 0, value)
+	}
+
+	return value, nil
+}
+
+type MultiplyTerm struct {
+	Left, Right Term
+	Span        token.Span
+}
+
+func (mulTerm MultiplyTerm) Solve() int { return solve(mulTerm) }
+
+func (mulTerm MultiplyTerm) Source() token.Span { return mulTerm.Span }
+
+func (mulTerm MultiplyTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	left, right, err := evaluateBoth(evaluator, mulTerm.Left, mulTerm.Right)
+	if err != nil {
+		return 0, err
+	}
+
+	product, fits := multiplyInt(left, right)
+	if !fits {
+		return 0, wrapSpan(ErrOverflow, mulTerm.Span)
+	}
+
+	if evaluator.Trace {
+		evaluator.traceOperation(mulTerm, left, "*", right, product)
+	}
+
+	return product, nil
+}
 
-func (subTerm SubtractTerm) Solve() int {
-	return subTerm.Left.Solve() - subTerm.Right.Solve()
+type DivideTerm struct {
+	Left, Right Term
+	Span        token.Span
 }
 
-type DiceTerm struct{ Count, Faces int }
+func (divTerm DivideTerm) Solve() int { return solve(divTerm) }
 
-func (diceTerm DiceTerm) Solve() int {
-	total := 0
+func (divTerm DivideTerm) Source() token.Span { return divTerm.Span }
+
+func (divTerm DivideTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	left, right, err := evaluateBoth(evaluator, divTerm.Left, divTerm.Right)
+	if err != nil {
+		return 0, err
+	}
+
+	if right == 0 {
+		return 0, wrapSpan(ErrDivisionByZero, divTerm.Span)
+	}
+
+	// The only quotient that does not fit is the lowest int divided by -1.
+	if right == -1 && left == math.MinInt {
+		return 0, wrapSpan(ErrOverflow, divTerm.Span)
+	}
+
+	if evaluator.Trace {
+		evaluator.traceOperation(divTerm, left, "/", right, left/right)
+	}
+
+	return left / right, nil
+}
+
+type AddTerm struct {
+	Left, Right Term
+	Span        token.Span
+}
+
+func (addTerm AddTerm) Solve() int { return solve(addTerm) }
+
+func (addTerm AddTerm) Source() token.Span { return addTerm.Span }
+
+func (addTerm AddTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	left, right, err := evaluateBoth(evaluator, addTerm.Left, addTerm.Right)
+	if err != nil {
+		return 0, err
+	}
+
+	sum, fits := addInt(left, right)
+	if !fits {
+		return 0, wrapSpan(ErrOverflow, addTerm.Span)
+	}
+
+	if evaluator.Trace {
+		evaluator.traceOperation(addTerm, left, "+", right, sum)
+	}
+
+	return sum, nil
+}
+
+type SubtractTerm struct {
+	Left, Right Term
+	Span        token.Span
+}
+
+func (subTerm SubtractTerm) Solve() int { return solve(subTerm) }
+
+func (subTerm SubtractTerm) Source() token.Span { return subTerm.Span }
+
+func (subTerm SubtractTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	left, err := subTerm.Left.Evaluate(evaluator)
+	if err != nil {
+		return 0, err
+	}
+
+	// Labels on the right take away from the total.
+	evaluator.negated = !evaluator.negated
+	right, err := subTerm.Right.Evaluate(evaluator)
+	evaluator.negated = !evaluator.negated
+
+	if err != nil {
+		return 0, err
+	}
+
+	difference, fits := subtractInt(left, right)
+	if !fits {
+		return 0, wrapSpan(ErrOverflow, subTerm.Span)
+	}
+
+	if evaluator.Trace {
+		evaluator.traceOperation(subTerm, left, "-", right, difference)
+	}
+
+	return difference, nil
+}
+
+type DiceTerm struct {
+	Count, Faces int
+	Span         token.Span
+}
+
+func (diceTerm DiceTerm) Solve() int { return solve(diceTerm) }
+
+func (diceTerm DiceTerm) Source() token.Span { return diceTerm.Span }
+
+func (diceTerm DiceTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	return evaluatePool(evaluator, diceTerm)
+}
+
+func (diceTerm DiceTerm) Roll(evaluator *Evaluator) (Roll, error) {
+	if err := evaluator.checkDice(diceTerm.Count, diceTerm.Faces); err != nil {
+		return Roll{}, wrapSpan(err, diceTerm.Span)
+	}
+
+	sampled := ShouldSample(diceTerm.Count, diceTerm.Faces)
+
+	if evaluator.Mode != Random {
+		// The mean of faces 1 to n is (n + 1) / 2.
+		mean := new(big.Rat).Add(big.NewRat(int64(diceTerm.Faces), 2), big.NewRat(1, 2)) //nolint:gomnd
+
+		return Roll{Group: false, Dice: evaluator.fixedDice(diceTerm.Count, 1, diceTerm.Faces, mean, sampled)}, nil
+	}
+
+	// Huge pools count the dice that rolled each value rather than listing
+	// every die.
+	if sampled {
+		return Roll{Group: false, Dice: sampleDice(diceTerm.Count, diceTerm.Faces)}, nil
+	}
+
+	roll := Roll{Group: false, Dice: make([]Die, 0, diceTerm.Count)}
 
 	for index := 0; index < diceTerm.Count; index++ {
+		if err := evaluator.interrupted(index); err != nil {
+			return Roll{}, wrapSpan(err, diceTerm.Span)
+		}
+
 		dieResult := rand.Intn(diceTerm.Faces) + 1 //nolint:gosec
-		total += dieResult
+		roll.Dice = append(roll.Dice, Die{Value: dieResult, Dropped: false, Critical: NotCritical, Count: 0})
+	}
+
+	return roll, nil
+}
+
+// DynamicDiceTerm rolls dice whose count and faces are only known after
+// solving other terms, such as (1d4)d6.
+type DynamicDiceTerm struct {
+	Count, Faces Term
+	Span         token.Span
+}
+
+func (diceTerm DynamicDiceTerm) Solve() int { return solve(diceTerm) }
+
+func (diceTerm DynamicDiceTerm) Source() token.Span { return diceTerm.Span }
+
+func (diceTerm DynamicDiceTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	return evaluatePool(evaluator, diceTerm)
+}
+
+func (diceTerm DynamicDiceTerm) Roll(evaluator *Evaluator) (Roll, error) {
+	count, faces, err := evaluateBoth(evaluator, diceTerm.Count, diceTerm.Faces)
+	if err != nil {
+		return Roll{}, err
+	}
+
+	return DiceTerm{Count: count, Faces: faces, Span: diceTerm.Span}.Roll(evaluator)
+}
+
+// Face is one side of a custom die. Faces with a higher weight are proportionally
+// more likely to be rolled.
+type Face struct {
+	Value  int `json:"value"`
+	Weight int `json:"weight"`
+}
+
+type CustomDiceTerm struct {
+	Count int
+	Faces []Face
+	Span  token.Span
+}
+
+func (diceTerm CustomDiceTerm) Solve() int { return solve(diceTerm) }
+
+func (diceTerm CustomDiceTerm) Source() token.Span { return diceTerm.Span }
+
+func (diceTerm CustomDiceTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	return evaluatePool(evaluator, diceTerm)
+}
+
+func (diceTerm CustomDiceTerm) Roll(evaluator *Evaluator) (Roll, error) {
+	if err := evaluator.checkDice(diceTerm.Count, len(diceTerm.Faces)); err != nil {
+		return Roll{}, wrapSpan(err, diceTerm.Span)
+	}
+
+	sampled := ShouldSample(diceTerm.Count, len(diceTerm.Faces))
+
+	if evaluator.Mode != Random {
+		low, high, mean := faceRange(diceTerm.Faces)
+
+		return Roll{Group: false, Dice: evaluator.fixedDice(diceTerm.Count, low, high, mean, sampled)}, nil
+	}
+
+	if sampled {
+		return Roll{Group: false, Dice: sampleCustomDice(diceTerm.Count, diceTerm.Faces)}, nil
+	}
+
+	totalWeight := 0
+
+	for _, face := range diceTerm.Faces {
+		totalWeight += face.Weight
 	}
 
-	return total
+	roll := Roll{Group: false, Dice: make([]Die, 0, diceTerm.Count)}
+
+	for index := 0; index < diceTerm.Count; index++ {
+		if err := evaluator.interrupted(index); err != nil {
+			return Roll{}, wrapSpan(err, diceTerm.Span)
+		}
+
+		pick := rand.Intn(totalWeight) //nolint:gosec
+
+		for _, face := range diceTerm.Faces {
+			if pick < face.Weight {
+				roll.Dice = append(roll.Dice, Die{Value: face.Value, Dropped: false, Critical: NotCritical, Count: 0})
+
+				break
+			}
+
+			pick -= face.Weight
+		}
+	}
+
+	return roll, nil
+}
+
+// LabelTerm names the part of the total that a term contributes, such as the
+// damage type in 2d6 [slashing].
+type LabelTerm struct {
+	Term  Term
+	Label string
+	Span  token.Span
+}
+
+func (labelTerm LabelTerm) Solve() int { return solve(labelTerm) }
+
+func (labelTerm LabelTerm) Source() token.Span { return labelTerm.Span }
+
+func (labelTerm LabelTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	labelledBefore := evaluator.labelled()
+
+	value, err := labelTerm.Term.Evaluate(evaluator)
+	if err != nil {
+		return 0, err
+	}
+
+	contribution := value
+	if evaluator.negated {
+		contribution = -value
+	}
+
+	// Labels inside this term keep their share of the total.
+	evaluator.addSubtotal(labelTerm.Label, contribution-(evaluator.labelled()-labelledBefore))
+
+	return value, nil
+}
+
+type IntTerm struct {
+	Value int
+	Span  token.Span
+}
+
+func (intTerm IntTerm) Solve() int { return solve(intTerm) }
+
+func (intTerm IntTerm) Source() token.Span { return intTerm.Span }
+
+func (intTerm IntTerm) Evaluate(*Evaluator) (int, error) {
+	return intTerm.Value, nil
+}
+
+// BigIntTerm is an integer too large for IntTerm. Only formulas evaluated with
+// EvaluateFormula can use its value.
+type BigIntTerm struct {
+	Value *big.Int
+	Span  token.Span
+}
+
+func (intTerm BigIntTerm) Solve() int { return solve(intTerm) }
+
+func (intTerm BigIntTerm) Source() token.Span { return intTerm.Span }
+
+func (intTerm BigIntTerm) Evaluate(*Evaluator) (int, error) {
+	return 0, wrapSpan(fmt.Errorf("%w: %v does not fit in an integer", ErrOverflow, intTerm.Value), intTerm.Span)
 }
 
-type IntTerm struct{ Value int }
+// AttributeTerm is a value that other dice rollers read from a character sheet,
+// such as @{strength_mod} in Roll20, or a query with no default answer. There
+// is no character sheet to read it from, so it is always 0.
+type AttributeTerm struct {
+	Name string
+	Span token.Span
+}
+
+func (attributeTerm AttributeTerm) Solve() int { return solve(attributeTerm) }
+
+func (attributeTerm AttributeTerm) Source() token.Span { return attributeTerm.Span }
+
+func (attributeTerm AttributeTerm) Evaluate(*Evaluator) (int, error) {
+	return 0, nil
+}
+
+func evaluateBoth(evaluator *Evaluator, leftTerm, rightTerm Term) (int, int, error) {
+	left, err := leftTerm.Evaluate(evaluator)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	right, err := rightTerm.Evaluate(evaluator)
+	if err != nil {
+		return 0, 0, err
+	}
 
-func (intTerm IntTerm) Solve() int {
-	return intTerm.Value
+	return left, right, nil
 }
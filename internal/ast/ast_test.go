@@ -1,19 +1,454 @@
 package ast_test
 
 import (
+	"context"
+	"math"
+	"math/big"
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/parser"
 )
 
 func TestSolve(t *testing.T) {
 	t.Parallel()
 
-	assert.Equal(t, 8, ast.MultiplyTerm{Left: ast.IntTerm{4}, Right: ast.IntTerm{2}}.Solve())
-	assert.Equal(t, 2, ast.DivideTerm{Left: ast.IntTerm{42}, Right: ast.IntTerm{21}}.Solve())
-	assert.Equal(t, 42, ast.AddTerm{Left: ast.IntTerm{40}, Right: ast.IntTerm{2}}.Solve())
-	assert.Equal(t, -2, ast.SubtractTerm{Left: ast.IntTerm{2}, Right: ast.IntTerm{4}}.Solve())
+	assert.Equal(t, 8, ast.MultiplyTerm{Left: ast.IntTerm{Value: 4}, Right: ast.IntTerm{Value: 2}}.Solve())
+	assert.Equal(t, 2, ast.DivideTerm{Left: ast.IntTerm{Value: 42}, Right: ast.IntTerm{Value: 21}}.Solve())
+	assert.Equal(t, 42, ast.AddTerm{Left: ast.IntTerm{Value: 40}, Right: ast.IntTerm{Value: 2}}.Solve())
+	assert.Equal(t, -2, ast.SubtractTerm{Left: ast.IntTerm{Value: 2}, Right: ast.IntTerm{Value: 4}}.Solve())
+	assert.Equal(t, 1, ast.CompareTerm{Comparison: ast.LessEqual, Left: ast.IntTerm{Value: 2}, Right: ast.IntTerm{Value: 2}}.Solve())
+	assert.Equal(t, 0, ast.CompareTerm{Comparison: ast.Greater, Left: ast.IntTerm{Value: 2}, Right: ast.IntTerm{Value: 2}}.Solve())
+	assert.Equal(t, 4, ast.ConditionalTerm{
+		Condition: ast.IntTerm{Value: 1},
+		Then:      ast.IntTerm{Value: 4},
+		// Solving this branch would panic, proving that it is skipped.
+		Else: ast.DivideTerm{Left: ast.IntTerm{Value: 1}, Right: ast.IntTerm{Value: 0}},
+	}.Solve())
+	// A custom die with a single face always rolls that face.
+	assert.Equal(t, -6, ast.CustomDiceTerm{Count: 3, Faces: []ast.Face{{Value: -2, Weight: 5}}}.Solve())
 	// Skip ast.DiceTerm so we don't have to deal with changes to the randomizer.
 	assert.Equal(t, 42, ast.IntTerm{Value: 42}.Solve())
 }
+
+func TestEvaluate(t *testing.T) {
+	t.Parallel()
+
+	evaluator := ast.NewEvaluator()
+	evaluator.Limits = ast.Limits{MaxDice: 10, MaxFaces: 6}
+
+	value, err := ast.DynamicDiceTerm{Count: ast.IntTerm{Value: 2}, Faces: ast.IntTerm{Value: 1}}.Evaluate(evaluator)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, value)
+
+	_, err = ast.DynamicDiceTerm{Count: ast.IntTerm{Value: 2}, Faces: ast.IntTerm{Value: 7}}.Evaluate(evaluator)
+	assert.ErrorIs(t, err, ast.ErrDiceFaces)
+
+	_, err = ast.DynamicDiceTerm{Count: ast.IntTerm{Value: -1}, Faces: ast.IntTerm{Value: 6}}.Evaluate(evaluator)
+	assert.ErrorIs(t, err, ast.ErrDiceCount)
+
+	// The limit applies to all dice rolled by the evaluator, so only 8 remain.
+	_, err = ast.DiceTerm{Count: 9, Faces: 6}.Evaluate(evaluator)
+	assert.ErrorIs(t, err, ast.ErrTooManyDice)
+
+	_, err = ast.DivideTerm{Left: ast.IntTerm{Value: 1}, Right: ast.IntTerm{Value: 0}}.Evaluate(evaluator)
+	assert.ErrorIs(t, err, ast.ErrDivisionByZero)
+}
+
+func TestEvaluateContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	evaluator := ast.NewEvaluatorContext(ctx)
+
+	value, err := ast.DiceTerm{Count: 2, Faces: 1}.Evaluate(evaluator)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, value)
+
+	cancel()
+
+	// Once the context is done no more dice are rolled, but dice-free terms
+	// are still evaluated.
+	results := evaluator.EvaluateFormula(&ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.AddTerm{Left: ast.IntTerm{Value: 1}, Right: ast.DiceTerm{Count: 1, Faces: 6}}},
+		{Name: "", Term: ast.IntTerm{Value: 3}},
+	}})
+	assert.ErrorIs(t, results[0].Err, context.Canceled)
+	assert.NoError(t, results[1].Err)
+	assert.Equal(t, 3, results[1].Value)
+}
+
+func TestOverflow(t *testing.T) {
+	t.Parallel()
+
+	// Evaluating terms directly reports overflow rather than wrapping.
+	for _, term := range []ast.Term{
+		ast.AddTerm{Left: ast.IntTerm{Value: math.MaxInt}, Right: ast.IntTerm{Value: 1}},
+		ast.SubtractTerm{Left: ast.IntTerm{Value: math.MinInt}, Right: ast.IntTerm{Value: 1}},
+		ast.MultiplyTerm{Left: ast.IntTerm{Value: math.MaxInt / 2}, Right: ast.IntTerm{Value: 3}},
+		ast.DivideTerm{Left: ast.IntTerm{Value: math.MinInt}, Right: ast.IntTerm{Value: -1}},
+		ast.BigIntTerm{Value: new(big.Int).Lsh(big.NewInt(1), 64)},
+	} {
+		_, err := term.Evaluate(ast.NewEvaluator())
+		assert.ErrorIs(t, err, ast.ErrOverflow, "%v should overflow", term)
+	}
+
+	// Formulas switch to arbitrary precision when they might overflow.
+	formula, err := parser.Parse(`
+		99999999999999999999 + 1,
+		9223372036854775807 * 2 / 2,
+		(2d1 * 9223372036854775807) [fire] - 99999999999999999999 [cold] + 3,
+		{99999999999999999999}kh1
+	`)
+	assert.NoError(t, err)
+
+	bigInt := func(value string) *big.Int {
+		bigValue, _ := new(big.Int).SetString(value, 10)
+
+		return bigValue
+	}
+
+	results := ast.NewEvaluator().EvaluateFormula(formula)
+	assert.Equal(t, bigInt("100000000000000000000"), results[0].Big)
+	assert.Equal(t, math.MaxInt, results[1].Value)
+	assert.Nil(t, results[1].Big)
+	assert.Equal(t, bigInt("-81553255926290448382"), results[2].Big)
+	assert.Equal(t, []ast.Subtotal{
+		{Label: "fire", Value: 0, Big: bigInt("18446744073709551614")},
+		{Label: "cold", Value: 0, Big: bigInt("-99999999999999999999")},
+	}, results[2].Subtotals)
+	assert.ErrorIs(t, results[3].Err, ast.ErrOverflow)
+}
+
+func TestModes(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		input    string
+		mode     ast.Mode
+		rounding ast.Rounding
+		value    int
+	}{
+		{input: "2d6 + 3", mode: ast.Average, rounding: ast.RoundDown, value: 10},
+		{input: "2d6 + 3", mode: ast.Maximum, rounding: ast.RoundDown, value: 15},
+		{input: "2d6 + 3", mode: ast.Minimum, rounding: ast.RoundDown, value: 5},
+		{input: "3d6", mode: ast.Average, rounding: ast.RoundDown, value: 10},
+		{input: "3d6", mode: ast.Average, rounding: ast.RoundUp, value: 11},
+		{input: "3d6", mode: ast.Average, rounding: ast.RoundNearest, value: 11},
+		{input: "0 - 1d4", mode: ast.Average, rounding: ast.RoundDown, value: -2},
+		{input: "(1d4)d(2d8)", mode: ast.Maximum, rounding: ast.RoundDown, value: 64},
+		// The mean of these faces is 1/4.
+		{input: "1d{-1, 0, 1:2}", mode: ast.Average, rounding: ast.RoundDown, value: 0},
+		{input: "1d{-1, 0, 1:2}", mode: ast.Average, rounding: ast.RoundUp, value: 1},
+		{input: "1d{-1, 0, 1:2}", mode: ast.Average, rounding: ast.RoundNearest, value: 0},
+		{input: "2d{-1, 0, 1:2}", mode: ast.Minimum, rounding: ast.RoundDown, value: -2},
+		// Dropping selects from the dice 4, 4, 3 and 3.
+		{input: "4d6dl1", mode: ast.Average, rounding: ast.RoundDown, value: 11},
+		{input: "{1d20, 1d20}kh1 >= 15", mode: ast.Maximum, rounding: ast.RoundDown, value: 1},
+		// Each pool is rounded as it was typed, rather than as 2d20.
+		{input: "1d20 + 1d20", mode: ast.Average, rounding: ast.RoundDown, value: 20},
+	} {
+		formula, err := parser.Parse(test.input)
+		assert.NoError(t, err, "%q should parse", test.input)
+
+		evaluator := ast.NewEvaluator()
+		evaluator.Mode, evaluator.Rounding = test.mode, test.rounding
+		result := evaluator.EvaluateFormula(ast.OptimizeMode(formula, test.mode))[0]
+
+		assert.NoError(t, result.Err)
+		assert.Equal(t, test.value, result.Value, "%q should be %v %v", test.input, test.mode, test.rounding)
+	}
+
+	// Modes apply to each die, so critical hits can be forced.
+	evaluator := ast.NewEvaluator()
+	evaluator.Mode = ast.Maximum
+	result := evaluator.EvaluateFormula(&ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.CriticalTerm{Pool: ast.DiceTerm{Count: 1, Faces: 20}, Critical: ast.CriticalSuccess, Comparison: ast.Equal, Target: 20}},
+	}})[0]
+	assert.True(t, result.CriticalSuccess)
+	assert.Equal(t, []ast.Roll{{Group: false, Dice: []ast.Die{{Value: 20, Dropped: false, Critical: ast.CriticalSuccess}}}}, result.Rolls)
+}
+
+func TestTrace(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse("(2d1 + 3) * 2, {2d1, 3}kh1 + 99999999999999999999, if(1d1 >= 2, 3, 2d1)")
+	assert.NoError(t, err)
+
+	evaluator := ast.NewEvaluator()
+	evaluator.Trace = true
+	results := evaluator.EvaluateFormula(formula)
+
+	type step struct {
+		term, operation, value string
+		dice                   []int
+	}
+
+	for index, expected := range [][]step{
+		{
+			{term: "2d1", operation: "", value: "2", dice: []int{1, 1}},
+			{term: "2d1 + 3", operation: "2 + 3", value: "5", dice: nil},
+			{term: "2d1 + 3 * 2", operation: "5 * 2", value: "10", dice: nil},
+		},
+		{
+			{term: "2d1", operation: "", value: "2", dice: []int{1, 1}},
+			{term: "{2d1, 3}kh1", operation: "", value: "3", dice: []int{2, 3}},
+			{
+				term:      "{2d1, 3}kh1 + 99999999999999999999",
+				operation: "3 + 99999999999999999999",
+				value:     "100000000000000000002",
+				dice:      nil,
+			},
+		},
+		{
+			{term: "1d1", operation: "", value: "1", dice: []int{1}},
+			{term: "1d1 >= 2", operation: "1 >= 2", value: "0", dice: nil},
+			{term: "2d1", operation: "", value: "2", dice: []int{1, 1}},
+			{term: "if(1d1 >= 2, 3, 2d1)", operation: "if(0) else 2d1", value: "2", dice: nil},
+		},
+	} {
+		steps := []step{}
+
+		for _, actual := range results[index].Steps {
+			var dice []int
+
+			if actual.Roll != nil {
+				for _, die := range actual.Roll.Dice {
+					dice = append(dice, die.Value)
+				}
+			}
+
+			steps = append(steps, step{term: actual.Term.String(), operation: actual.Operation, value: actual.Value, dice: dice})
+		}
+
+		assert.Equal(t, expected, steps, "equation %v should have the expected steps", index)
+	}
+
+	// Steps are only recorded when asked for.
+	assert.Empty(t, ast.NewEvaluator().EvaluateFormula(formula)[0].Steps)
+}
+
+func TestPool(t *testing.T) {
+	t.Parallel()
+
+	group := ast.GroupTerm{Members: []ast.Term{ast.IntTerm{Value: 3}, ast.IntTerm{Value: 9}, ast.IntTerm{Value: 1}, ast.IntTerm{Value: 5}}}
+
+	assert.Equal(t, 18, group.Solve())
+	assert.Equal(t, 14, ast.KeepTerm{Pool: group, Selection: ast.KeepHighest, Count: 2}.Solve())
+	assert.Equal(t, 4, ast.KeepTerm{Pool: group, Selection: ast.KeepLowest, Count: 2}.Solve())
+	assert.Equal(t, 9, ast.KeepTerm{Pool: group, Selection: ast.DropHighest, Count: 1}.Solve())
+	assert.Equal(t, 18, ast.KeepTerm{Pool: group, Selection: ast.DropLowest, Count: 0}.Solve())
+	assert.Equal(t, 0, ast.KeepTerm{Pool: group, Selection: ast.DropLowest, Count: 10}.Solve())
+	assert.Equal(t, 2, ast.SuccessTerm{Pool: group, Comparison: ast.GreaterEqual, Target: 5}.Solve())
+
+	// Dropping the lowest of the two highest values only leaves 9.
+	roll, err := ast.CriticalTerm{
+		Pool:       ast.KeepTerm{Pool: group, Selection: ast.KeepHighest, Count: 2},
+		Critical:   ast.CriticalSuccess,
+		Comparison: ast.GreaterEqual,
+		Target:     5,
+	}.Roll(ast.NewEvaluator())
+	assert.NoError(t, err)
+	assert.Equal(t, ast.Roll{Group: true, Dice: []ast.Die{
+		{Value: 3, Dropped: true, Critical: ast.NotCritical},
+		{Value: 9, Dropped: false, Critical: ast.CriticalSuccess},
+		{Value: 1, Dropped: true, Critical: ast.NotCritical},
+		{Value: 5, Dropped: false, Critical: ast.CriticalSuccess},
+	}}, roll)
+
+	roll, err = ast.KeepTerm{
+		Pool:      ast.KeepTerm{Pool: group, Selection: ast.KeepHighest, Count: 2},
+		Selection: ast.DropLowest,
+		Count:     1,
+	}.Roll(ast.NewEvaluator())
+	assert.NoError(t, err)
+	assert.Equal(t, ast.Roll{Group: true, Dice: []ast.Die{
+		{Value: 3, Dropped: true, Critical: ast.NotCritical},
+		{Value: 9, Dropped: false, Critical: ast.NotCritical},
+		{Value: 1, Dropped: true, Critical: ast.NotCritical},
+		{Value: 5, Dropped: true, Critical: ast.NotCritical},
+	}}, roll)
+
+	// Only the critical failure on 1 survives keeping the lowest value.
+	results := ast.NewEvaluator().EvaluateFormula(&ast.Formula{Equations: []ast.Equation{
+		{Name: "worst", Term: ast.KeepTerm{
+			Pool: ast.CriticalTerm{
+				Pool: ast.CriticalTerm{
+					Pool:       group,
+					Critical:   ast.CriticalSuccess,
+					Comparison: ast.Equal,
+					Target:     9,
+				},
+				Critical:   ast.CriticalFailure,
+				Comparison: ast.Equal,
+				Target:     1,
+			},
+			Selection: ast.KeepLowest,
+			Count:     1,
+		}},
+		{Name: "", Term: ast.DivideTerm{Left: ast.IntTerm{Value: 1}, Right: ast.IntTerm{Value: 0}}},
+	}})
+	assert.Equal(t, []ast.Result{
+		{
+			Name:  "worst",
+			Value: 1,
+			Rolls: []ast.Roll{{Group: true, Dice: []ast.Die{
+				{Value: 3, Dropped: true, Critical: ast.NotCritical},
+				{Value: 9, Dropped: true, Critical: ast.CriticalSuccess},
+				{Value: 1, Dropped: false, Critical: ast.CriticalFailure},
+				{Value: 5, Dropped: true, Critical: ast.NotCritical},
+			}}},
+			CriticalSuccess: false,
+			CriticalFailure: true,
+			Err:             nil,
+		},
+		{Name: "", Value: 0, Rolls: nil, CriticalSuccess: false, CriticalFailure: false, Err: ast.ErrDivisionByZero},
+	}, results)
+}
+
+func TestLabels(t *testing.T) {
+	t.Parallel()
+
+	// (4 [fire] + 2) [magic] - 1 [fire] + 3 [cold] + 10 [magic] - 5
+	results := ast.NewEvaluator().EvaluateFormula(&ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.SubtractTerm{
+			Left: ast.AddTerm{
+				Left: ast.AddTerm{
+					Left: ast.SubtractTerm{
+						Left: ast.LabelTerm{
+							Term:  ast.AddTerm{Left: ast.LabelTerm{Term: ast.IntTerm{Value: 4}, Label: "fire"}, Right: ast.IntTerm{Value: 2}},
+							Label: "magic",
+						},
+						Right: ast.LabelTerm{Term: ast.IntTerm{Value: 1}, Label: "fire"},
+					},
+					Right: ast.LabelTerm{Term: ast.IntTerm{Value: 3}, Label: "cold"},
+				},
+				Right: ast.LabelTerm{Term: ast.IntTerm{Value: 10}, Label: "magic"},
+			},
+			Right: ast.IntTerm{Value: 5},
+		}},
+	}})
+	assert.Equal(t, 13, results[0].Value)
+	assert.Equal(t, []ast.Subtotal{
+		{Label: "fire", Value: 3},
+		{Label: "magic", Value: 12},
+		{Label: "cold", Value: 3},
+	}, results[0].Subtotals)
+}
+
+type depthVisitor struct {
+	depth    *int
+	maxDepth *int
+}
+
+func (visitor depthVisitor) Visit(term ast.Term) ast.Visitor {
+	if term == nil {
+		*visitor.depth--
+
+		return nil
+	}
+
+	*visitor.depth++
+	*visitor.maxDepth = max(*visitor.maxDepth, *visitor.depth)
+
+	return visitor
+}
+
+func TestWalk(t *testing.T) {
+	t.Parallel()
+
+	// if(1d20 >= 15, {2d6 [fire], 3}kh1, (1d4)d6)
+	term := ast.ConditionalTerm{
+		Condition: ast.CompareTerm{Comparison: ast.GreaterEqual, Left: ast.DiceTerm{Count: 1, Faces: 20}, Right: ast.IntTerm{Value: 15}},
+		Then: ast.KeepTerm{
+			Pool: ast.GroupTerm{Members: []ast.Term{
+				ast.LabelTerm{Term: ast.DiceTerm{Count: 2, Faces: 6}, Label: "fire"},
+				ast.IntTerm{Value: 3},
+			}},
+			Selection: ast.KeepHighest,
+			Count:     1,
+		},
+		Else: ast.DynamicDiceTerm{Count: ast.DiceTerm{Count: 1, Faces: 4}, Faces: ast.IntTerm{Value: 6}},
+	}
+
+	visited := []string{}
+
+	ast.Inspect(term, func(term ast.Term) bool {
+		if term != nil {
+			visited = append(visited, term.String())
+		}
+
+		// Skip the members of groups.
+		_, isGroup := term.(ast.GroupTerm)
+
+		return !isGroup
+	})
+	assert.Equal(t, []string{
+		"if(1d20 >= 15, {2d6 [fire], 3}kh1, (1d4)d6)",
+		"1d20 >= 15",
+		"1d20",
+		"15",
+		"{2d6 [fire], 3}kh1",
+		"{2d6 [fire], 3}",
+		"(1d4)d6",
+		"1d4",
+		"6",
+	}, visited)
+
+	depth, maxDepth := 0, 0
+
+	ast.Walk(depthVisitor{depth: &depth, maxDepth: &maxDepth}, term)
+	assert.Equal(t, 0, depth)
+	assert.Equal(t, 5, maxDepth)
+}
+
+func TestOptimize(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"1d20 + 2 + 3 - 1":                               "1d20 + 4",
+		"1d6 + 2d6 - 1d8 - 1d8 + 1d4":                    "3d6 - 2d8 + 1d4",
+		"2 - 1d6 - 2":                                    "0 - 1d6",
+		"1d6 + 1d6kh1 + 1d6 [fire] - 1d6 + 1d6":          "2d6 + 1d6kh1 + 1d6 [fire] - 1d6",
+		"(1 + 2) [fire] + (3 * 1d4) * 1":                 "3 [fire] + (3 * 1d4)",
+		"(2)d(3 * 2) / 1 * 1 + 5 / 0":                    "2d6 * 6 / 0",
+		"if(1 >= 2, 1d4, 1d6 + 1) + 1d6":                 "2d6 + 1",
+		"if(1d20 >= 2 * 5, 1d4 + 0, 0 + 0)":              "if(1d20 >= 10, 1d4, 0)",
+		"{1 + 1, 1d4 + 1d4}kh1 {3 - 3}>=0":               "{2, 2d4}kh1, {0}>=0",
+		"9223372036854775807 + 1d4 + 1 - 2":              "1d4 + 9223372036854775806",
+		"9223372036854775807 + 1 + 99999999999999999999": "109223372036854775807",
+		"4611686018427387904 * 2":                        "4611686018427387904 * 2",
+	}
+
+	for input, expected := range tests {
+		formula, err := parser.Parse(input)
+		assert.NoError(t, err, "%q should parse", input)
+		assert.Equal(t, expected, ast.Optimize(formula).String(), "%q should optimize", input)
+	}
+
+	// Formulas without dice should evaluate the same once optimized.
+	generator := formulaGenerator{random: rand.New(rand.NewSource(1))} //nolint:gosec
+
+	for iteration := 0; iteration < 2000; iteration++ {
+		formula := generator.formula()
+		hasPools := false
+
+		for _, equation := range formula.Equations {
+			ast.Inspect(equation.Term, func(term ast.Term) bool {
+				_, isPool := term.(ast.Pool)
+				hasPools = hasPools || isPool
+
+				return !hasPools
+			})
+		}
+
+		if !hasPools {
+			assert.Equal(t,
+				ast.NewEvaluator().EvaluateFormula(formula),
+				ast.NewEvaluator().EvaluateFormula(ast.Optimize(formula)),
+				"%v should evaluate the same once optimized", formula)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package ast
+
+import (
+	"math"
+	"math/big"
+
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+// Add two ints and report whether the sum fits in an int.
+func addInt(left, right int) (int, bool) {
+	sum := left + right
+
+	return sum, (sum > left) == (right > 0)
+}
+
+// Subtract two ints and report whether the difference fits in an int.
+func subtractInt(left, right int) (int, bool) {
+	difference := left - right
+
+	return difference, (difference < left) == (right > 0)
+}
+
+// Multiply two ints and report whether the product fits in an int.
+func multiplyInt(left, right int) (int, bool) {
+	if left == 0 || right == 0 {
+		return 0, true
+	}
+
+	product := left * right
+
+	if (left == -1 && right == math.MinInt) || (right == -1 && left == math.MinInt) {
+		return product, false
+	}
+
+	return product, product/right == left
+}
+
+// NewIntTerm returns an IntTerm for value if it fits, and a BigIntTerm
+// otherwise.
+func NewIntTerm(value *big.Int, span token.Span) Term {
+	if token.FitsInt(value) {
+		return IntTerm{Value: int(value.Int64()), Span: span}
+	}
+
+	return BigIntTerm{Value: value, Span: span}
+}
+
+// Split value into an int, or a nil *big.Int when it fits, and the *big.Int
+// itself when it does not.
+func splitBig(value *big.Int) (int, *big.Int) {
+	if value == nil {
+		return 0, nil
+	}
+
+	if token.FitsInt(value) {
+		return int(value.Int64()), nil
+	}
+
+	return 0, value
+}
+
+// Evaluate term with arbitrary precision. Pools are still rolled with ints, so
+// their dice and members must fit in one, but their totals need not.
+//
+//nolint:cyclop,funlen
+func (evaluator *Evaluator) evaluateBig(term Term) (*big.Int, error) {
+	switch term := term.(type) {
+	case IntTerm:
+		return big.NewInt(int64(term.Value)), nil
+	case BigIntTerm:
+		return new(big.Int).Set(term.Value), nil
+	case CompareTerm:
+		left, right, err := evaluator.evaluateBigBoth(term.Left, term.Right)
+		if err != nil {
+			return nil, err
+		}
+
+		value := big.NewInt(0)
+		if term.Comparison.Compare(left.Cmp(right), 0) {
+			value.SetInt64(1)
+		}
+
+		if evaluator.Trace {
+			evaluator.traceOperation(term, left, term.Comparison.String(), right, value)
+		}
+
+		return value, nil
+	case ConditionalTerm:
+		condition, err := evaluator.evaluateBig(term.Condition)
+		if err != nil {
+			return nil, err
+		}
+
+		branch := term.Else
+		if condition.Sign() != 0 {
+			branch = term.Then
+		}
+
+		value, err := evaluator.evaluateBig(branch)
+		if err != nil {
+			return nil, err
+		}
+
+		if evaluator.Trace {
+			evaluator.traceBranch(term, condition, condition.Sign() != 0, value)
+		}
+
+		return value, nil
+	case MultiplyTerm:
+		left, right, err := evaluator.evaluateBigBoth(term.Left, term.Right)
+		if err != nil {
+			return nil, err
+		}
+
+		return evaluator.traceBig(term, left, "*", right, new(big.Int).Mul(left, right)), nil
+	case DivideTerm:
+		left, right, err := evaluator.evaluateBigBoth(term.Left, term.Right)
+		if err != nil {
+			return nil, err
+		}
+
+		if right.Sign() == 0 {
+			return nil, wrapSpan(ErrDivisionByZero, term.Span)
+		}
+
+		// Quo truncates toward zero like integer division.
+		return evaluator.traceBig(term, left, "/", right, new(big.Int).Quo(left, right)), nil
+	case AddTerm:
+		left, right, err := evaluator.evaluateBigBoth(term.Left, term.Right)
+		if err != nil {
+			return nil, err
+		}
+
+		return evaluator.traceBig(term, left, "+", right, new(big.Int).Add(left, right)), nil
+	case SubtractTerm:
+		left, err := evaluator.evaluateBig(term.Left)
+		if err != nil {
+			return nil, err
+		}
+
+		evaluator.negated = !evaluator.negated
+		right, err := evaluator.evaluateBig(term.Right)
+		evaluator.negated = !evaluator.negated
+
+		if err != nil {
+			return nil, err
+		}
+
+		return evaluator.traceBig(term, left, "-", right, new(big.Int).Sub(left, right)), nil
+	case LabelTerm:
+		labelledBefore := evaluator.labelledBig()
+
+		value, err := evaluator.evaluateBig(term.Term)
+		if err != nil {
+			return nil, err
+		}
+
+		contribution := new(big.Int).Set(value)
+		if evaluator.negated {
+			contribution.Neg(contribution)
+		}
+
+		// Labels inside this term keep their share of the total.
+		inner := evaluator.labelledBig()
+		inner.Sub(inner, labelledBefore)
+		evaluator.addBigSubtotal(term.Label, contribution.Sub(contribution, inner))
+
+		return value, nil
+	case Pool:
+		roll, err := term.Roll(evaluator)
+		if err != nil {
+			return nil, err
+		}
+
+		evaluator.rolls = append(evaluator.rolls, roll)
+
+		total := new(big.Int)
+
+		for _, die := range roll.Dice {
+			if !die.Dropped {
+				value := big.NewInt(int64(die.Value))
+				total.Add(total, value.Mul(value, big.NewInt(int64(die.Times()))))
+			}
+		}
+
+		if evaluator.Trace {
+			evaluator.traceRoll(term, roll, total)
+		}
+
+		return total, nil
+	default:
+		value, err := term.Evaluate(evaluator)
+		if err != nil {
+			return nil, err
+		}
+
+		return big.NewInt(int64(value)), nil
+	}
+}
+
+// Trace an operation with arbitrary precision and return its value.
+func (evaluator *Evaluator) traceBig(term Term, left *big.Int, operator string, right, value *big.Int) *big.Int {
+	if evaluator.Trace {
+		evaluator.traceOperation(term, left, operator, right, value)
+	}
+
+	return value
+}
+
+func (evaluator *Evaluator) evaluateBigBoth(leftTerm, rightTerm Term) (*big.Int, *big.Int, error) {
+	left, err := evaluator.evaluateBig(leftTerm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	right, err := evaluator.evaluateBig(rightTerm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return left, right, nil
+}
+
+// Add to a label's subtotal with arbitrary precision. Pools rolled in between
+// still add to Value, so the subtotal is the sum of both until it is settled.
+func (evaluator *Evaluator) addBigSubtotal(label string, value *big.Int) {
+	for index, subtotal := range evaluator.subtotals {
+		if subtotal.Label == label {
+			if subtotal.Big == nil {
+				evaluator.subtotals[index].Big = new(big.Int)
+			}
+
+			evaluator.subtotals[index].Big.Add(evaluator.subtotals[index].Big, value)
+
+			return
+		}
+	}
+
+	evaluator.subtotals = append(evaluator.subtotals, Subtotal{Label: label, Value: 0, Big: value})
+}
+
+// Sum the values of every label recorded so far with arbitrary precision.
+func (evaluator *Evaluator) labelledBig() *big.Int {
+	total := new(big.Int)
+
+	for _, subtotal := range evaluator.subtotals {
+		total.Add(total, big.NewInt(int64(subtotal.Value)))
+
+		if subtotal.Big != nil {
+			total.Add(total, subtotal.Big)
+		}
+	}
+
+	return total
+}
+
+// Move each subtotal into Value if it fits, or into Big if it does not.
+func (evaluator *Evaluator) settleSubtotals() {
+	for index, subtotal := range evaluator.subtotals {
+		if subtotal.Big != nil {
+			total := new(big.Int).Add(subtotal.Big, big.NewInt(int64(subtotal.Value)))
+			evaluator.subtotals[index].Value, evaluator.subtotals[index].Big = splitBig(total)
+		}
+	}
+}
+
+// interval bounds the values a term may evaluate to.
+type interval struct {
+	low, high *big.Int
+}
+
+func pointInterval(value *big.Int) interval {
+	return interval{low: value, high: value}
+}
+
+// boundsChecker finds the range of values each term may take, recording
+// whether any of them may not fit in an int.
+type boundsChecker struct {
+	overflows bool
+}
+
+// Report whether evaluating term with ints could overflow, whatever is rolled.
+func mayOverflow(term Term) bool {
+	checker := boundsChecker{overflows: false}
+	checker.bounds(term)
+
+	return checker.overflows
+}
+
+func (checker *boundsChecker) bounds(term Term) interval {
+	bounds := checker.termBounds(term)
+
+	if !token.FitsInt(bounds.low) || !token.FitsInt(bounds.high) {
+		checker.overflows = true
+	}
+
+	return bounds
+}
+
+//nolint:cyclop,funlen
+func (checker *boundsChecker) termBounds(term Term) interval {
+	switch term := term.(type) {
+	case IntTerm:
+		return pointInterval(big.NewInt(int64(term.Value)))
+	case BigIntTerm:
+		return pointInterval(term.Value)
+	case AttributeTerm:
+		return pointInterval(big.NewInt(0))
+	case CompareTerm:
+		checker.bounds(term.Left)
+		checker.bounds(term.Right)
+
+		return interval{low: big.NewInt(0), high: big.NewInt(1)}
+	case ConditionalTerm:
+		checker.bounds(term.Condition)
+
+		then, otherwise := checker.bounds(term.Then), checker.bounds(term.Else)
+
+		return interval{low: minBig(then.low, otherwise.low), high: maxBig(then.high, otherwise.high)}
+	case MultiplyTerm:
+		left, right := checker.bounds(term.Left), checker.bounds(term.Right)
+		products := []*big.Int{
+			new(big.Int).Mul(left.low, right.low),
+			new(big.Int).Mul(left.low, right.high),
+			new(big.Int).Mul(left.high, right.low),
+			new(big.Int).Mul(left.high, right.high),
+		}
+
+		return interval{low: minBig(products...), high: maxBig(products...)}
+	case DivideTerm:
+		left := checker.bounds(term.Left)
+		checker.bounds(term.Right)
+
+		// Dividing by a non-zero integer never grows the magnitude, but
+		// may flip the sign.
+		magnitude := maxBig(new(big.Int).Abs(left.low), new(big.Int).Abs(left.high))
+
+		return interval{low: new(big.Int).Neg(magnitude), high: magnitude}
+	case AddTerm:
+		left, right := checker.bounds(term.Left), checker.bounds(term.Right)
+
+		return interval{low: new(big.Int).Add(left.low, right.low), high: new(big.Int).Add(left.high, right.high)}
+	case SubtractTerm:
+		left, right := checker.bounds(term.Left), checker.bounds(term.Right)
+
+		return interval{low: new(big.Int).Sub(left.low, right.high), high: new(big.Int).Sub(left.high, right.low)}
+	case LabelTerm:
+		return checker.bounds(term.Term)
+	case SuccessTerm:
+		_, count := checker.dieBounds(term.Pool)
+
+		return interval{low: big.NewInt(0), high: count}
+	case Pool:
+		// Any of the dice may be dropped.
+		die, count := checker.dieBounds(term)
+
+		return interval{
+			low:  new(big.Int).Mul(count, minBig(die.low, big.NewInt(0))),
+			high: new(big.Int).Mul(count, maxBig(die.high, big.NewInt(0))),
+		}
+	default:
+		return interval{low: big.NewInt(math.MinInt), high: big.NewInt(math.MaxInt)}
+	}
+}
+
+// Return the bounds of a single die or member of pool and how many it may
+// have at most.
+func (checker *boundsChecker) dieBounds(pool Pool) (interval, *big.Int) {
+	one := big.NewInt(1)
+
+	switch pool := pool.(type) {
+	case DiceTerm:
+		faces := big.NewInt(int64(pool.Faces))
+
+		return interval{low: minBig(one, faces), high: maxBig(one, faces)}, big.NewInt(int64(max(pool.Count, 0)))
+	case DynamicDiceTerm:
+		count, faces := checker.bounds(pool.Count), checker.bounds(pool.Faces)
+
+		return interval{low: one, high: maxBig(one, faces.high)}, maxBig(count.high, big.NewInt(0))
+	case CustomDiceTerm:
+		die := interval{low: big.NewInt(0), high: big.NewInt(0)}
+
+		for index, face := range pool.Faces {
+			value := big.NewInt(int64(face.Value))
+
+			if index == 0 {
+				die = pointInterval(value)
+			}
+
+			die = interval{low: minBig(die.low, value), high: maxBig(die.high, value)}
+		}
+
+		return die, big.NewInt(int64(max(pool.Count, 0)))
+	case GroupTerm:
+		die := interval{low: big.NewInt(0), high: big.NewInt(0)}
+
+		for index, member := range pool.Members {
+			bounds := checker.bounds(member)
+
+			if index == 0 {
+				die = bounds
+			}
+
+			die = interval{low: minBig(die.low, bounds.low), high: maxBig(die.high, bounds.high)}
+		}
+
+		return die, big.NewInt(int64(len(pool.Members)))
+	case KeepTerm:
+		return checker.dieBounds(pool.Pool)
+	case CriticalTerm:
+		return checker.dieBounds(pool.Pool)
+	default:
+		return interval{low: big.NewInt(math.MinInt), high: big.NewInt(math.MaxInt)}, big.NewInt(math.MaxInt)
+	}
+}
+
+func minBig(values ...*big.Int) *big.Int {
+	lowest := values[0]
+
+	for _, value := range values[1:] {
+		if value.Cmp(lowest) < 0 {
+			lowest = value
+		}
+	}
+
+	return lowest
+}
+
+func maxBig(values ...*big.Int) *big.Int {
+	highest := values[0]
+
+	for _, value := range values[1:] {
+		if value.Cmp(highest) > 0 {
+			highest = value
+		}
+	}
+
+	return highest
+}
@@ -0,0 +1,273 @@
+package ast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+var (
+	ErrDivisionByZero = errors.New("division by zero")
+	ErrTooManyDice    = errors.New("too many dice")
+	ErrDiceCount      = errors.New("invalid dice count")
+	ErrDiceFaces      = errors.New("invalid dice faces")
+	ErrOverflow       = errors.New("integer overflow")
+)
+
+// EvaluationError points at the term that could not be evaluated.
+type EvaluationError struct {
+	Span token.Span
+	Err  error
+}
+
+func (evaluationError *EvaluationError) Error() string {
+	return fmt.Sprintf("line %v column %v: %v",
+		evaluationError.Span.Start.Line,
+		evaluationError.Span.Start.Column,
+		evaluationError.Err)
+}
+
+func (evaluationError *EvaluationError) Unwrap() error {
+	return evaluationError.Err
+}
+
+// Wrap an error with the span of the term that raised it, unless the term was
+// built by hand and has no span.
+func wrapSpan(err error, span token.Span) error {
+	if span == (token.Span{}) {
+		return err
+	}
+
+	return &EvaluationError{Span: span, Err: err}
+}
+
+// Limits keep a single formula from tying up the bot.
+type Limits struct {
+	// MaxDice is the number of dice that may be rolled across all terms.
+	// Pools that are sampled cost as many dice as they have faces, since
+	// that is what they take to roll.
+	MaxDice int
+	// MaxFaces is the number of faces a single die may have.
+	MaxFaces int
+	// MaxSampledDice is the number of dice a single pool that is sampled
+	// may have.
+	MaxSampledDice int
+}
+
+var DefaultLimits = Limits{
+	MaxDice:  1000,    //nolint:gomnd
+	MaxFaces: 1000000, //nolint:gomnd
+	// A trillion dice do not fit in an int on 32-bit platforms.
+	MaxSampledDice: min(1000000000000, math.MaxInt), //nolint:gomnd
+}
+
+// Evaluator carries the state shared by every term while evaluating a formula.
+// Use a new evaluator for each formula so that limits apply per formula.
+type Evaluator struct {
+	Limits Limits
+	// Mode decides what dice roll, and Rounding how averages are rounded
+	// in the Average mode.
+	Mode     Mode
+	Rounding Rounding
+	// Trace records the steps taken to evaluate each equation in its
+	// result, at some cost to speed.
+	Trace      bool
+	steps      []Step
+	ctx        context.Context //nolint:containedctx
+	diceRolled int
+	rolls      []Roll
+	subtotals  []Subtotal
+	// Set while evaluating a term that is subtracted from the total.
+	negated bool
+}
+
+func NewEvaluator() *Evaluator {
+	return NewEvaluatorContext(context.Background())
+}
+
+// NewEvaluatorContext returns an evaluator that stops rolling dice with the
+// error of ctx once it is done.
+func NewEvaluatorContext(ctx context.Context) *Evaluator {
+	return &Evaluator{
+		Limits:     DefaultLimits,
+		Mode:       Random,
+		Rounding:   RoundDown,
+		Trace:      false,
+		steps:      nil,
+		ctx:        ctx,
+		diceRolled: 0,
+		rolls:      nil,
+		subtotals:  nil,
+		negated:    false,
+	}
+}
+
+// How many dice to roll between checks of the context.
+const contextInterval = 1024
+
+// Report the error of the evaluator's context every contextInterval dice.
+func (evaluator *Evaluator) interrupted(diceRolled int) error {
+	if diceRolled%contextInterval != contextInterval-1 {
+		return nil
+	}
+
+	return evaluator.ctx.Err() //nolint:wrapcheck
+}
+
+// Subtotal is the part of a result contributed by terms with the same label.
+type Subtotal struct {
+	Label string `json:"label"`
+	Value int    `json:"value"`
+	// Big is set instead of Value when the subtotal does not fit in an int.
+	Big *big.Int `json:"big,omitempty"`
+}
+
+// Result is the outcome of evaluating a single equation.
+type Result struct {
+	Name  string
+	Value int
+	// Big is set instead of Value when the value does not fit in an int.
+	Big *big.Int
+	// Rolls lists every pool rolled by the equation in the order they
+	// finished rolling.
+	Rolls []Roll
+	// Subtotals lists each label in the order it first appeared. Values
+	// without a label are left out, and labels only add up to the value
+	// when their terms are added or subtracted.
+	Subtotals []Subtotal
+	// CriticalSuccess and CriticalFailure are set when any die that was
+	// not dropped was marked as critical.
+	CriticalSuccess bool
+	CriticalFailure bool
+	// Steps lists how the value was reduced when the evaluator traces.
+	Steps []Step
+	Err   error
+}
+
+// EvaluateFormula evaluates every equation in order. An error in one equation
+// does not stop the others from being evaluated. Equations whose values could
+// overflow an int are evaluated with arbitrary precision instead.
+func (evaluator *Evaluator) EvaluateFormula(formula *Formula) []Result {
+	results := make([]Result, 0, len(formula.Equations))
+
+	for _, equation := range formula.Equations {
+		evaluator.rolls = nil
+		evaluator.subtotals = nil
+		evaluator.steps = nil
+
+		var (
+			value    int
+			bigValue *big.Int
+			err      error
+		)
+
+		if mayOverflow(equation.Term) {
+			bigValue, err = evaluator.evaluateBig(equation.Term)
+			value, bigValue = splitBig(bigValue)
+
+			evaluator.settleSubtotals()
+		} else {
+			value, err = equation.Term.Evaluate(evaluator)
+		}
+
+		result := Result{
+			Name:            equation.Name,
+			Value:           value,
+			Big:             bigValue,
+			Rolls:           evaluator.rolls,
+			Subtotals:       evaluator.subtotals,
+			CriticalSuccess: false,
+			CriticalFailure: false,
+			Steps:           evaluator.steps,
+			Err:             err,
+		}
+
+		for _, roll := range result.Rolls {
+			success, failure := roll.Critical()
+			result.CriticalSuccess = result.CriticalSuccess || success
+			result.CriticalFailure = result.CriticalFailure || failure
+		}
+
+		results = append(results, result)
+	}
+
+	evaluator.rolls = nil
+	evaluator.subtotals = nil
+	evaluator.steps = nil
+
+	return results
+}
+
+// Check that count dice with the given number of faces may be rolled and
+// count them against the evaluator's limits.
+func (evaluator *Evaluator) checkDice(count, faces int) error {
+	if err := evaluator.ctx.Err(); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	cost, err := evaluator.Limits.CheckDice(count, faces, evaluator.diceRolled)
+	if err != nil {
+		return err
+	}
+
+	evaluator.diceRolled += cost
+
+	return nil
+}
+
+// CheckDice reports whether count dice with the given number of faces may be
+// rolled after diceRolled dice have already been rolled, and returns how many
+// dice they count as.
+func (limits Limits) CheckDice(count, faces, diceRolled int) (int, error) {
+	if count < 0 {
+		return 0, fmt.Errorf("%w: cannot roll %v dice", ErrDiceCount, count)
+	}
+
+	if faces < 1 || faces > limits.MaxFaces {
+		return 0, fmt.Errorf("%w: dice must have between 1 and %v faces, got %v",
+			ErrDiceFaces, limits.MaxFaces, faces)
+	}
+
+	cost := count
+
+	if ShouldSample(count, faces) {
+		if count > limits.MaxSampledDice {
+			return 0, fmt.Errorf("%w: cannot roll more than %v dice at once", ErrTooManyDice, limits.MaxSampledDice)
+		}
+
+		cost = faces
+	}
+
+	if cost > limits.MaxDice-diceRolled {
+		return 0, fmt.Errorf("%w: cannot roll more than %v dice in one formula", ErrTooManyDice, limits.MaxDice)
+	}
+
+	return cost, nil
+}
+
+func (evaluator *Evaluator) addSubtotal(label string, value int) {
+	for index, subtotal := range evaluator.subtotals {
+		if subtotal.Label == label {
+			evaluator.subtotals[index].Value += value
+
+			return
+		}
+	}
+
+	evaluator.subtotals = append(evaluator.subtotals, Subtotal{Label: label, Value: value, Big: nil})
+}
+
+// Sum the values of every label recorded so far.
+func (evaluator *Evaluator) labelled() int {
+	total := 0
+
+	for _, subtotal := range evaluator.subtotals {
+		total += subtotal.Value
+	}
+
+	return total
+}
@@ -0,0 +1,44 @@
+package ast
+
+import "fmt"
+
+// Step is one reduction made while evaluating a formula, such as adding two
+// values or rolling a pool.
+type Step struct {
+	// Term is the term that was reduced.
+	Term Term
+	// Roll holds the dice of a pool that was rolled.
+	Roll *Roll
+	// Operation shows the values the term was reduced from, such as "8 + 3",
+	// and is empty for pools.
+	Operation string
+	// Value is what the term was reduced to.
+	Value string
+}
+
+// Record that term was reduced to value by applying operator to left and
+// right. Callers check Trace first so that terms are not boxed needlessly.
+func (evaluator *Evaluator) traceOperation(term Term, left any, operator string, right, value any) {
+	evaluator.steps = append(evaluator.steps, Step{
+		Term:      term,
+		Roll:      nil,
+		Operation: fmt.Sprintf("%v %v %v", left, operator, right),
+		Value:     fmt.Sprint(value),
+	})
+}
+
+// Record that a conditional term with the given condition took branch and
+// reduced to value.
+func (evaluator *Evaluator) traceBranch(term ConditionalTerm, condition any, taken bool, value any) {
+	operation := fmt.Sprintf("if(%v) then %v", condition, term.Then)
+	if !taken {
+		operation = fmt.Sprintf("if(%v) else %v", condition, term.Else)
+	}
+
+	evaluator.steps = append(evaluator.steps, Step{Term: term, Roll: nil, Operation: operation, Value: fmt.Sprint(value)})
+}
+
+// Record that pool was rolled.
+func (evaluator *Evaluator) traceRoll(pool Term, roll Roll, value any) {
+	evaluator.steps = append(evaluator.steps, Step{Term: pool, Roll: &roll, Operation: "", Value: fmt.Sprint(value)})
+}
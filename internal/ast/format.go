@@ -0,0 +1,286 @@
+package ast
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Precedence levels from loosest to tightest binding. Addition and subtraction
+// bind tighter than multiplication and division, as they do in the parser.
+const (
+	precedenceCompare = iota
+	precedenceMultiply
+	precedenceAdd
+	precedenceLabel
+	precedenceBottom
+)
+
+func precedence(term Term) int {
+	switch term.(type) {
+	case CompareTerm:
+		return precedenceCompare
+	case MultiplyTerm, DivideTerm:
+		return precedenceMultiply
+	case AddTerm, SubtractTerm:
+		return precedenceAdd
+	case LabelTerm:
+		return precedenceLabel
+	default:
+		return precedenceBottom
+	}
+}
+
+// Format term in parentheses unless it binds at least as tightly as level.
+func format(term Term, level int) string {
+	if precedence(term) < level {
+		return "(" + term.String() + ")"
+	}
+
+	return term.String()
+}
+
+// Report whether term is printed ending with a group and its modifiers, which a
+// following comparison would count the successes of.
+func endsWithGroup(term Term) bool {
+	switch term := term.(type) {
+	case GroupTerm:
+		return true
+	case KeepTerm:
+		return endsWithGroup(term.Pool)
+	case CriticalTerm:
+		return endsWithGroup(term.Pool)
+	case MultiplyTerm:
+		return precedence(term.Right) >= precedenceAdd && endsWithGroup(term.Right)
+	case DivideTerm:
+		return precedence(term.Right) >= precedenceAdd && endsWithGroup(term.Right)
+	case AddTerm:
+		return precedence(term.Right) >= precedenceLabel && endsWithGroup(term.Right)
+	case SubtractTerm:
+		return precedence(term.Right) >= precedenceLabel && endsWithGroup(term.Right)
+	default:
+		return false
+	}
+}
+
+// String prints the formula in the form parser.Parse reads back, with each
+// equation separated by a comma.
+func (formula Formula) String() string {
+	equations := make([]string, 0, len(formula.Equations))
+
+	for _, equation := range formula.Equations {
+		equations = append(equations, equation.String())
+	}
+
+	return strings.Join(equations, ", ")
+}
+
+func (equation Equation) String() string {
+	if equation.Name == "" {
+		return equation.Term.String()
+	}
+
+	return formatName(equation.Name) + " = " + equation.Term.String()
+}
+
+// Print a name as it was typed if each of its words would be read back as a
+// word, or quoted otherwise.
+func formatName(name string) string {
+	for _, word := range strings.Split(name, " ") {
+		if !isWord(word) {
+			return strconv.Quote(name)
+		}
+	}
+
+	return name
+}
+
+func isWord(word string) bool {
+	first, size := utf8.DecodeRuneInString(word)
+	if first != '_' && !unicode.IsLetter(first) {
+		return false
+	}
+
+	// "d" followed by digits is a dice term.
+	if second, _ := utf8.DecodeRuneInString(word[size:]); strings.ContainsRune("dDｄＤ", first) && unicode.IsDigit(second) {
+		return false
+	}
+
+	for _, currentRune := range word {
+		if currentRune != '_' && !unicode.IsLetter(currentRune) && !unicode.IsNumber(currentRune) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (comparison Comparison) String() string {
+	switch comparison {
+	case Equal:
+		return "=="
+	case NotEqual:
+		return "!="
+	case Less:
+		return "<"
+	case LessEqual:
+		return "<="
+	case Greater:
+		return ">"
+	case GreaterEqual:
+		return ">="
+	default:
+		return fmt.Sprintf("Comparison(%d)", int(comparison))
+	}
+}
+
+func (cmpTerm CompareTerm) String() string {
+	left := format(cmpTerm.Left, precedenceMultiply)
+
+	// Keep "{1d20, 1d20} >= 15" from counting successes.
+	if precedence(cmpTerm.Left) >= precedenceMultiply && endsWithGroup(cmpTerm.Left) {
+		left = "(" + left + ")"
+	}
+
+	return left + " " + cmpTerm.Comparison.String() + " " + format(cmpTerm.Right, precedenceMultiply)
+}
+
+func (condTerm ConditionalTerm) String() string {
+	return fmt.Sprintf("if(%v, %v, %v)", condTerm.Condition, condTerm.Then, condTerm.Else)
+}
+
+func (mulTerm MultiplyTerm) String() string {
+	return format(mulTerm.Left, precedenceMultiply) + " * " + format(mulTerm.Right, precedenceAdd)
+}
+
+func (divTerm DivideTerm) String() string {
+	return format(divTerm.Left, precedenceMultiply) + " / " + format(divTerm.Right, precedenceAdd)
+}
+
+func (addTerm AddTerm) String() string {
+	return format(addTerm.Left, precedenceAdd) + " + " + format(addTerm.Right, precedenceLabel)
+}
+
+func (subTerm SubtractTerm) String() string {
+	return format(subTerm.Left, precedenceAdd) + " - " + format(subTerm.Right, precedenceLabel)
+}
+
+// Print the count of a dice term, which must be parenthesised unless it is a
+// literal.
+func formatCount(count Term) string {
+	if intTerm, isInt := count.(IntTerm); isInt && intTerm.Value >= 0 {
+		return intTerm.String()
+	}
+
+	return "(" + count.String() + ")"
+}
+
+func (diceTerm DiceTerm) String() string {
+	faces := strconv.Itoa(diceTerm.Faces)
+	if diceTerm.Faces < 0 {
+		faces = "(" + faces + ")"
+	}
+
+	return formatCount(IntTerm{Value: diceTerm.Count}) + "d" + faces //nolint:exhaustruct
+}
+
+func (diceTerm DynamicDiceTerm) String() string {
+	// Literal faces after a literal count would be read back as a DiceTerm.
+	_, isIntCount := diceTerm.Count.(IntTerm)
+	if faces, isInt := diceTerm.Faces.(IntTerm); isInt && faces.Value >= 0 && !isIntCount {
+		return formatCount(diceTerm.Count) + "d" + faces.String()
+	}
+
+	return formatCount(diceTerm.Count) + "d(" + diceTerm.Faces.String() + ")"
+}
+
+func (face Face) String() string {
+	if face.Weight == 1 {
+		return strconv.Itoa(face.Value)
+	}
+
+	return fmt.Sprintf("%v:%v", face.Value, face.Weight)
+}
+
+func (diceTerm CustomDiceTerm) String() string {
+	faces := make([]string, 0, len(diceTerm.Faces))
+
+	for _, face := range diceTerm.Faces {
+		faces = append(faces, face.String())
+	}
+
+	return strconv.Itoa(diceTerm.Count) + "d{" + strings.Join(faces, ", ") + "}"
+}
+
+func (labelTerm LabelTerm) String() string {
+	return format(labelTerm.Term, precedenceBottom) + " [" + labelTerm.Label + "]"
+}
+
+func (intTerm IntTerm) String() string {
+	return strconv.Itoa(intTerm.Value)
+}
+
+func (intTerm BigIntTerm) String() string {
+	return intTerm.Value.String()
+}
+
+func (attributeTerm AttributeTerm) String() string {
+	return attributeTerm.Name
+}
+
+func (groupTerm GroupTerm) String() string {
+	members := make([]string, 0, len(groupTerm.Members))
+
+	for _, member := range groupTerm.Members {
+		members = append(members, member.String())
+	}
+
+	return "{" + strings.Join(members, ", ") + "}"
+}
+
+func (selection Selection) String() string {
+	switch selection {
+	case KeepHighest:
+		return "kh"
+	case KeepLowest:
+		return "kl"
+	case DropHighest:
+		return "dh"
+	case DropLowest:
+		return "dl"
+	default:
+		return fmt.Sprintf("Selection(%d)", int(selection))
+	}
+}
+
+func (keepTerm KeepTerm) String() string {
+	return fmt.Sprintf("%v%v%v", keepTerm.Pool, keepTerm.Selection, keepTerm.Count)
+}
+
+func (successTerm SuccessTerm) String() string {
+	return fmt.Sprintf("%v%v%v", successTerm.Pool, successTerm.Comparison, successTerm.Target)
+}
+
+func (critical Critical) String() string {
+	switch critical {
+	case NotCritical:
+		return ""
+	case CriticalSuccess:
+		return "cs"
+	case CriticalFailure:
+		return "cf"
+	default:
+		return fmt.Sprintf("Critical(%d)", int(critical))
+	}
+}
+
+func (critTerm CriticalTerm) String() string {
+	// "cs20" is short for "cs==20".
+	if critTerm.Comparison == Equal && critTerm.Target >= 0 {
+		return fmt.Sprintf("%v%v%v", critTerm.Pool, critTerm.Critical, critTerm.Target)
+	}
+
+	return fmt.Sprintf("%v%v%v%v", critTerm.Pool, critTerm.Critical, critTerm.Comparison, critTerm.Target)
+}
@@ -0,0 +1,165 @@
+package ast_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/parser"
+)
+
+func TestString(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"D20 -8":                               "1d20 - 8",
+		"5 + 2 * 8 / 4":                        "5 + 2 * 8 / 4",
+		"(5 * 2) + (8 - 1) - -1":               "(5 * 2) + (8 - 1) - -1",
+		"2 * (3 * 4)":                          "2 * (3 * 4)",
+		"(1 >= 2) == (3)":                      "(1 >= 2) == 3",
+		"d(d4) (1d4)d6 (2)d8 3d(6)kh1":         "1d(1d4), (1d4)d6, 2d8, 3d(6)kh1",
+		"d{1, 2:3,-1}":                         "1d{1, 2:3, -1}",
+		"{2d6+1, d12}KH1 {d20, d20}cs20>=15":   "{2d6 + 1, 1d12}kh1, {1d20, 1d20}cs20>=15",
+		"d20cs>=19cf1":                         "1d20cs>=19cf1",
+		"({1d20, 1d20}) > 1":                   "({1d20, 1d20}) > 1",
+		"IF(d20>=15,2d6[ fire ],0)":            "if(1d20 >= 15, 2d6 [fire], 0)",
+		`"Attack #2" = 1, Lvl  "x" = 2, d = 3`: `"Attack #2" = 1, Lvl x = 2, d = 3`,
+		`"d20" = 1, "2" = 2`:                   `"d20" = 1, "2" = 2`,
+	}
+
+	for input, expected := range tests {
+		formula, err := parser.Parse(input)
+		assert.NoError(t, err, "%q should parse", input)
+		assert.Equal(t, expected, formula.String(), "%q should print canonically", input)
+	}
+}
+
+// Printing any formula the parser can produce and parsing it again should give
+// back the same formula.
+func TestStringRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	generator := formulaGenerator{random: rand.New(rand.NewSource(1))} //nolint:gosec
+
+	for iteration := 0; iteration < 2000; iteration++ {
+		formula := generator.formula()
+
+		parsed, err := parser.Parse(formula.String())
+		if assert.NoError(t, err, "%v should parse", formula) {
+			assert.Equal(t, formula, ast.WithoutSpans(parsed), "%v should round-trip", formula)
+		}
+	}
+}
+
+type formulaGenerator struct {
+	random *rand.Rand
+}
+
+func (generator formulaGenerator) formula() *ast.Formula {
+	names := []string{"", "", "attack", "Sneak attack", "Attack #2", "d20", "Lvl 5 Fireball", "d"}
+	equations := []ast.Equation{}
+
+	for count := generator.random.Intn(3) + 1; count > 0; count-- {
+		equations = append(equations, ast.Equation{
+			Name: names[generator.random.Intn(len(names))],
+			Term: generator.term(4), //nolint:gomnd
+		})
+	}
+
+	return &ast.Formula{Equations: equations}
+}
+
+func (generator formulaGenerator) int() int {
+	return generator.random.Intn(41) - 20 //nolint:gomnd
+}
+
+func (generator formulaGenerator) natural() int {
+	return generator.random.Intn(21) //nolint:gomnd
+}
+
+func (generator formulaGenerator) comparison() ast.Comparison {
+	return ast.Comparison(generator.random.Intn(int(ast.GreaterEqual) + 1))
+}
+
+//nolint:cyclop,funlen,gomnd
+func (generator formulaGenerator) term(depth int) ast.Term {
+	if depth == 0 {
+		return ast.IntTerm{Value: generator.int()}
+	}
+
+	switch generator.random.Intn(10) {
+	case 0:
+		return ast.CompareTerm{Comparison: generator.comparison(), Left: generator.term(depth - 1), Right: generator.term(depth - 1)}
+	case 1:
+		return ast.ConditionalTerm{Condition: generator.term(depth - 1), Then: generator.term(depth - 1), Else: generator.term(depth - 1)}
+	case 2:
+		return ast.MultiplyTerm{Left: generator.term(depth - 1), Right: generator.term(depth - 1)}
+	case 3:
+		return ast.DivideTerm{Left: generator.term(depth - 1), Right: generator.term(depth - 1)}
+	case 4:
+		return ast.AddTerm{Left: generator.term(depth - 1), Right: generator.term(depth - 1)}
+	case 5:
+		return ast.SubtractTerm{Left: generator.term(depth - 1), Right: generator.term(depth - 1)}
+	case 6:
+		labels := []string{"fire", "cold iron", "+1 sword"}
+
+		return ast.LabelTerm{Term: generator.term(depth - 1), Label: labels[generator.random.Intn(len(labels))]}
+	case 7:
+		return generator.pool(depth - 1)
+	case 8:
+		pool := ast.Pool(ast.GroupTerm{Members: []ast.Term{generator.term(depth - 1), generator.term(depth - 1)}})
+		pool = generator.modifiers(pool)
+
+		return ast.SuccessTerm{Pool: pool, Comparison: generator.comparison(), Target: generator.int()}
+	default:
+		return ast.IntTerm{Value: generator.int()}
+	}
+}
+
+//nolint:gomnd
+func (generator formulaGenerator) pool(depth int) ast.Pool {
+	var pool ast.Pool
+
+	switch generator.random.Intn(4) {
+	case 0:
+		pool = ast.DiceTerm{Count: generator.natural(), Faces: generator.natural()}
+	case 1:
+		count := ast.Term(ast.IntTerm{Value: generator.natural()})
+		if generator.random.Intn(2) == 0 {
+			count = generator.term(depth)
+		}
+
+		pool = ast.DynamicDiceTerm{Count: count, Faces: generator.term(depth)}
+	case 2:
+		faces := []ast.Face{}
+
+		for count := generator.random.Intn(3) + 1; count > 0; count-- {
+			faces = append(faces, ast.Face{Value: generator.int(), Weight: generator.random.Intn(3) + 1})
+		}
+
+		pool = ast.CustomDiceTerm{Count: generator.natural(), Faces: faces}
+	default:
+		pool = ast.GroupTerm{Members: []ast.Term{generator.term(depth)}}
+	}
+
+	return generator.modifiers(pool)
+}
+
+//nolint:gomnd
+func (generator formulaGenerator) modifiers(pool ast.Pool) ast.Pool {
+	for generator.random.Intn(3) == 0 {
+		if generator.random.Intn(2) == 0 {
+			pool = ast.KeepTerm{Pool: pool, Selection: ast.Selection(generator.random.Intn(4)), Count: generator.natural()}
+		} else {
+			pool = ast.CriticalTerm{
+				Pool:       pool,
+				Critical:   ast.Critical(generator.random.Intn(2) + 1),
+				Comparison: generator.comparison(),
+				Target:     generator.int(),
+			}
+		}
+	}
+
+	return pool
+}
@@ -0,0 +1,600 @@
+package ast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+var ErrInvalidJSON = errors.New("invalid formula JSON")
+
+// The type of each term in JSON. These names are stored by other services, so
+// they must not change.
+const (
+	jsonCompare     = "compare"
+	jsonConditional = "if"
+	jsonMultiply    = "multiply"
+	jsonDivide      = "divide"
+	jsonAdd         = "add"
+	jsonSubtract    = "subtract"
+	jsonDice        = "dice"
+	jsonDynamicDice = "dynamicDice"
+	jsonCustomDice  = "customDice"
+	jsonLabel       = "label"
+	jsonInt         = "int"
+	jsonGroup       = "group"
+	jsonKeep        = "keep"
+	jsonSuccess     = "success"
+	jsonCritical    = "critical"
+	jsonAttribute   = "attribute"
+)
+
+// termJSON holds the fields of every kind of term. Only the fields of the kind
+// named by Type are set.
+type termJSON struct {
+	Type       string            `json:"type"`
+	Value      *big.Int          `json:"value,omitempty"`
+	Comparison *Comparison       `json:"comparison,omitempty"`
+	Condition  json.RawMessage   `json:"condition,omitempty"`
+	Then       json.RawMessage   `json:"then,omitempty"`
+	Else       json.RawMessage   `json:"else,omitempty"`
+	Left       json.RawMessage   `json:"left,omitempty"`
+	Right      json.RawMessage   `json:"right,omitempty"`
+	Count      json.RawMessage   `json:"count,omitempty"`
+	Faces      json.RawMessage   `json:"faces,omitempty"`
+	Term       json.RawMessage   `json:"term,omitempty"`
+	Label      *string           `json:"label,omitempty"`
+	Name       *string           `json:"name,omitempty"`
+	Members    []json.RawMessage `json:"members,omitempty"`
+	Pool       json.RawMessage   `json:"pool,omitempty"`
+	Selection  *Selection        `json:"selection,omitempty"`
+	Critical   *Critical         `json:"critical,omitempty"`
+	Target     *int              `json:"target,omitempty"`
+	Span       *token.Span       `json:"span,omitempty"`
+}
+
+func (cmpTerm CompareTerm) MarshalJSON() ([]byte, error) { return marshalTerm(cmpTerm) }
+
+func (condTerm ConditionalTerm) MarshalJSON() ([]byte, error) { return marshalTerm(condTerm) }
+
+func (mulTerm MultiplyTerm) MarshalJSON() ([]byte, error) { return marshalTerm(mulTerm) }
+
+func (divTerm DivideTerm) MarshalJSON() ([]byte, error) { return marshalTerm(divTerm) }
+
+func (addTerm AddTerm) MarshalJSON() ([]byte, error) { return marshalTerm(addTerm) }
+
+func (subTerm SubtractTerm) MarshalJSON() ([]byte, error) { return marshalTerm(subTerm) }
+
+func (diceTerm DiceTerm) MarshalJSON() ([]byte, error) { return marshalTerm(diceTerm) }
+
+func (diceTerm DynamicDiceTerm) MarshalJSON() ([]byte, error) { return marshalTerm(diceTerm) }
+
+func (diceTerm CustomDiceTerm) MarshalJSON() ([]byte, error) { return marshalTerm(diceTerm) }
+
+func (labelTerm LabelTerm) MarshalJSON() ([]byte, error) { return marshalTerm(labelTerm) }
+
+func (intTerm IntTerm) MarshalJSON() ([]byte, error) { return marshalTerm(intTerm) }
+
+func (intTerm BigIntTerm) MarshalJSON() ([]byte, error) { return marshalTerm(intTerm) }
+
+func (groupTerm GroupTerm) MarshalJSON() ([]byte, error) { return marshalTerm(groupTerm) }
+
+func (keepTerm KeepTerm) MarshalJSON() ([]byte, error) { return marshalTerm(keepTerm) }
+
+func (successTerm SuccessTerm) MarshalJSON() ([]byte, error) { return marshalTerm(successTerm) }
+
+func (critTerm CriticalTerm) MarshalJSON() ([]byte, error) { return marshalTerm(critTerm) }
+
+func (attributeTerm AttributeTerm) MarshalJSON() ([]byte, error) { return marshalTerm(attributeTerm) }
+
+//nolint:cyclop,funlen
+func marshalTerm(term Term) ([]byte, error) {
+	encoded := termJSON{} //nolint:exhaustruct
+	encoder := termEncoder{err: nil}
+
+	switch term := term.(type) {
+	case CompareTerm:
+		encoded.Type, encoded.Comparison = jsonCompare, &term.Comparison
+		encoded.Left, encoded.Right = encoder.term(term.Left), encoder.term(term.Right)
+	case ConditionalTerm:
+		encoded.Type = jsonConditional
+		encoded.Condition = encoder.term(term.Condition)
+		encoded.Then, encoded.Else = encoder.term(term.Then), encoder.term(term.Else)
+	case MultiplyTerm:
+		encoded.Type = jsonMultiply
+		encoded.Left, encoded.Right = encoder.term(term.Left), encoder.term(term.Right)
+	case DivideTerm:
+		encoded.Type = jsonDivide
+		encoded.Left, encoded.Right = encoder.term(term.Left), encoder.term(term.Right)
+	case AddTerm:
+		encoded.Type = jsonAdd
+		encoded.Left, encoded.Right = encoder.term(term.Left), encoder.term(term.Right)
+	case SubtractTerm:
+		encoded.Type = jsonSubtract
+		encoded.Left, encoded.Right = encoder.term(term.Left), encoder.term(term.Right)
+	case DiceTerm:
+		encoded.Type = jsonDice
+		encoded.Count, encoded.Faces = encoder.value(term.Count), encoder.value(term.Faces)
+	case DynamicDiceTerm:
+		encoded.Type = jsonDynamicDice
+		encoded.Count, encoded.Faces = encoder.term(term.Count), encoder.term(term.Faces)
+	case CustomDiceTerm:
+		encoded.Type = jsonCustomDice
+		encoded.Count, encoded.Faces = encoder.value(term.Count), encoder.value(term.Faces)
+	case LabelTerm:
+		encoded.Type, encoded.Label = jsonLabel, &term.Label
+		encoded.Term = encoder.term(term.Term)
+	case IntTerm:
+		encoded.Type, encoded.Value = jsonInt, big.NewInt(int64(term.Value))
+	case BigIntTerm:
+		encoded.Type, encoded.Value = jsonInt, term.Value
+	case GroupTerm:
+		encoded.Type = jsonGroup
+
+		for _, member := range term.Members {
+			encoded.Members = append(encoded.Members, encoder.term(member))
+		}
+	case KeepTerm:
+		encoded.Type, encoded.Selection = jsonKeep, &term.Selection
+		encoded.Pool, encoded.Count = encoder.term(term.Pool), encoder.value(term.Count)
+	case SuccessTerm:
+		encoded.Type, encoded.Comparison, encoded.Target = jsonSuccess, &term.Comparison, &term.Target
+		encoded.Pool = encoder.term(term.Pool)
+	case CriticalTerm:
+		encoded.Type, encoded.Critical = jsonCritical, &term.Critical
+		encoded.Comparison, encoded.Target = &term.Comparison, &term.Target
+		encoded.Pool = encoder.term(term.Pool)
+	case AttributeTerm:
+		encoded.Type, encoded.Name = jsonAttribute, &term.Name
+	default:
+		return nil, fmt.Errorf("%w: cannot encode %T", ErrInvalidJSON, term)
+	}
+
+	if encoder.err != nil {
+		return nil, encoder.err
+	}
+
+	if span := term.Source(); span != (token.Span{}) {
+		encoded.Span = &span
+	}
+
+	return json.Marshal(encoded) //nolint:wrapcheck
+}
+
+// termEncoder encodes the fields of a term, keeping the first error so that
+// each field does not need to be checked separately.
+type termEncoder struct {
+	err error
+}
+
+func (encoder *termEncoder) value(value any) json.RawMessage {
+	if encoder.err != nil {
+		return nil
+	}
+
+	data, err := json.Marshal(value)
+	encoder.err = err
+
+	return data
+}
+
+func (encoder *termEncoder) term(term Term) json.RawMessage {
+	return encoder.value(term)
+}
+
+// UnmarshalTerm decodes a term encoded by json.Marshal.
+//
+//nolint:cyclop,funlen,gocognit
+func UnmarshalTerm(data []byte) (Term, error) {
+	var encoded termJSON
+
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidJSON, err)
+	}
+
+	span := token.Span{}
+	if encoded.Span != nil {
+		span = *encoded.Span
+	}
+
+	decoder := termDecoder{err: nil}
+
+	var term Term
+
+	switch encoded.Type {
+	case jsonCompare:
+		term = CompareTerm{
+			Comparison: decoder.comparison(encoded.Comparison),
+			Left:       decoder.term(encoded.Left),
+			Right:      decoder.term(encoded.Right),
+			Span:       span,
+		}
+	case jsonConditional:
+		term = ConditionalTerm{
+			Condition: decoder.term(encoded.Condition),
+			Then:      decoder.term(encoded.Then),
+			Else:      decoder.term(encoded.Else),
+			Span:      span,
+		}
+	case jsonMultiply:
+		term = MultiplyTerm{Left: decoder.term(encoded.Left), Right: decoder.term(encoded.Right), Span: span}
+	case jsonDivide:
+		term = DivideTerm{Left: decoder.term(encoded.Left), Right: decoder.term(encoded.Right), Span: span}
+	case jsonAdd:
+		term = AddTerm{Left: decoder.term(encoded.Left), Right: decoder.term(encoded.Right), Span: span}
+	case jsonSubtract:
+		term = SubtractTerm{Left: decoder.term(encoded.Left), Right: decoder.term(encoded.Right), Span: span}
+	case jsonDice:
+		term = DiceTerm{Count: decoder.int(encoded.Count), Faces: decoder.int(encoded.Faces), Span: span}
+	case jsonDynamicDice:
+		term = DynamicDiceTerm{Count: decoder.term(encoded.Count), Faces: decoder.term(encoded.Faces), Span: span}
+	case jsonCustomDice:
+		term = CustomDiceTerm{Count: decoder.int(encoded.Count), Faces: decoder.faces(encoded.Faces), Span: span}
+	case jsonLabel:
+		label := ""
+		if encoded.Label != nil {
+			label = *encoded.Label
+		}
+
+		term = LabelTerm{Term: decoder.term(encoded.Term), Label: label, Span: span}
+	case jsonInt:
+		if encoded.Value == nil {
+			return nil, fmt.Errorf("%w: missing integer", ErrInvalidJSON)
+		}
+
+		term = NewIntTerm(encoded.Value, span)
+	case jsonGroup:
+		members := make([]Term, 0, len(encoded.Members))
+
+		for _, member := range encoded.Members {
+			members = append(members, decoder.term(member))
+		}
+
+		term = GroupTerm{Members: members, Span: span}
+	case jsonKeep:
+		selection := KeepHighest
+		if encoded.Selection != nil {
+			selection = *encoded.Selection
+		}
+
+		term = KeepTerm{Pool: decoder.pool(encoded.Pool), Selection: selection, Count: decoder.int(encoded.Count), Span: span}
+	case jsonSuccess:
+		term = SuccessTerm{
+			Pool:       decoder.pool(encoded.Pool),
+			Comparison: decoder.comparison(encoded.Comparison),
+			Target:     decoder.required(encoded.Target),
+			Span:       span,
+		}
+	case jsonCritical:
+		critical := CriticalSuccess
+		if encoded.Critical != nil {
+			critical = *encoded.Critical
+		}
+
+		term = CriticalTerm{
+			Pool:       decoder.pool(encoded.Pool),
+			Critical:   critical,
+			Comparison: decoder.comparison(encoded.Comparison),
+			Target:     decoder.required(encoded.Target),
+			Span:       span,
+		}
+	case jsonAttribute:
+		if encoded.Name == nil {
+			return nil, fmt.Errorf("%w: missing attribute name", ErrInvalidJSON)
+		}
+
+		term = AttributeTerm{Name: *encoded.Name, Span: span}
+	default:
+		return nil, fmt.Errorf("%w: unknown term type %q", ErrInvalidJSON, encoded.Type)
+	}
+
+	if decoder.err != nil {
+		return nil, decoder.err
+	}
+
+	return term, nil
+}
+
+// termDecoder decodes the fields of a term, keeping the first error so that
+// each field does not need to be checked separately.
+type termDecoder struct {
+	err error
+}
+
+func (decoder *termDecoder) term(data json.RawMessage) Term {
+	if decoder.err != nil {
+		return nil
+	}
+
+	if len(data) == 0 {
+		decoder.err = fmt.Errorf("%w: missing term", ErrInvalidJSON)
+
+		return nil
+	}
+
+	term, err := UnmarshalTerm(data)
+	decoder.err = err
+
+	return term
+}
+
+func (decoder *termDecoder) pool(data json.RawMessage) Pool {
+	term := decoder.term(data)
+	if decoder.err != nil {
+		return nil
+	}
+
+	pool, isPool := term.(Pool)
+	if !isPool {
+		decoder.err = fmt.Errorf("%w: %T is not a pool", ErrInvalidJSON, term)
+	}
+
+	return pool
+}
+
+func (decoder *termDecoder) decode(data json.RawMessage, value any) {
+	if decoder.err != nil {
+		return
+	}
+
+	if err := json.Unmarshal(data, value); err != nil {
+		decoder.err = fmt.Errorf("%w: %w", ErrInvalidJSON, err)
+	}
+}
+
+// Decode the faces of a custom die with the rules the parser applies: there is
+// at least one face, every weight is positive, and the total weight fits in an
+// int so that the dice can be rolled.
+func (decoder *termDecoder) faces(data json.RawMessage) []Face {
+	faces := []Face{}
+	decoder.decode(data, &faces)
+
+	if decoder.err != nil {
+		return nil
+	}
+
+	if len(faces) == 0 {
+		decoder.err = fmt.Errorf("%w: custom dice must have at least one face", ErrInvalidJSON)
+
+		return nil
+	}
+
+	totalWeight := 0
+
+	for _, face := range faces {
+		if face.Weight < 1 {
+			decoder.err = fmt.Errorf("%w: face weights must be positive, got %v", ErrInvalidJSON, face.Weight)
+
+			return nil
+		}
+
+		if face.Weight > math.MaxInt-totalWeight {
+			decoder.err = fmt.Errorf("%w: total weight of faces does not fit in an integer", ErrInvalidJSON)
+
+			return nil
+		}
+
+		totalWeight += face.Weight
+	}
+
+	return faces
+}
+
+func (decoder *termDecoder) int(data json.RawMessage) int {
+	value := 0
+	decoder.decode(data, &value)
+
+	return value
+}
+
+func (decoder *termDecoder) required(value *int) int {
+	if value == nil {
+		if decoder.err == nil {
+			decoder.err = fmt.Errorf("%w: missing integer", ErrInvalidJSON)
+		}
+
+		return 0
+	}
+
+	return *value
+}
+
+func (decoder *termDecoder) comparison(comparison *Comparison) Comparison {
+	if comparison == nil {
+		if decoder.err == nil {
+			decoder.err = fmt.Errorf("%w: missing comparison", ErrInvalidJSON)
+		}
+
+		return Equal
+	}
+
+	return *comparison
+}
+
+type equationJSON struct {
+	Name string          `json:"name"`
+	Term json.RawMessage `json:"term"`
+	Span *token.Span     `json:"span,omitempty"`
+	// Ordinals are left out when unknown.
+	Ordinal int `json:"ordinal,omitempty"`
+}
+
+func (equation Equation) MarshalJSON() ([]byte, error) {
+	term, err := json.Marshal(equation.Term)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	encoded := equationJSON{Name: equation.Name, Term: term, Span: nil, Ordinal: equation.Ordinal}
+	if equation.Span != (token.Span{}) {
+		encoded.Span = &equation.Span
+	}
+
+	return json.Marshal(encoded) //nolint:wrapcheck
+}
+
+func (equation *Equation) UnmarshalJSON(data []byte) error {
+	var encoded equationJSON
+
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidJSON, err)
+	}
+
+	term, err := UnmarshalTerm(encoded.Term)
+	if err != nil {
+		return err
+	}
+
+	equation.Name, equation.Term, equation.Span, equation.Ordinal = encoded.Name, term, token.Span{}, encoded.Ordinal
+	if encoded.Span != nil {
+		equation.Span = *encoded.Span
+	}
+
+	return nil
+}
+
+type resultJSON struct {
+	Name            string     `json:"name"`
+	Value           int        `json:"value"`
+	Big             *big.Int   `json:"big,omitempty"`
+	Rolls           []Roll     `json:"rolls"`
+	Subtotals       []Subtotal `json:"subtotals"`
+	CriticalSuccess bool       `json:"criticalSuccess"`
+	CriticalFailure bool       `json:"criticalFailure"`
+	Steps           []Step     `json:"steps,omitempty"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// MarshalJSON encodes the result with its error, if any, as a message.
+func (result Result) MarshalJSON() ([]byte, error) {
+	encoded := resultJSON{
+		Name:            result.Name,
+		Value:           result.Value,
+		Big:             result.Big,
+		Rolls:           result.Rolls,
+		Subtotals:       result.Subtotals,
+		CriticalSuccess: result.CriticalSuccess,
+		CriticalFailure: result.CriticalFailure,
+		Steps:           result.Steps,
+		Error:           "",
+	}
+
+	if result.Err != nil {
+		encoded.Error = result.Err.Error()
+	}
+
+	return json.Marshal(encoded) //nolint:wrapcheck
+}
+
+// UnmarshalJSON decodes a result. Errors can only be compared by their message
+// once decoded.
+func (result *Result) UnmarshalJSON(data []byte) error {
+	var encoded resultJSON
+
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidJSON, err)
+	}
+
+	*result = Result{
+		Name:            encoded.Name,
+		Value:           encoded.Value,
+		Big:             encoded.Big,
+		Rolls:           encoded.Rolls,
+		Subtotals:       encoded.Subtotals,
+		CriticalSuccess: encoded.CriticalSuccess,
+		CriticalFailure: encoded.CriticalFailure,
+		Steps:           encoded.Steps,
+		Err:             nil,
+	}
+
+	if encoded.Error != "" {
+		result.Err = errors.New(encoded.Error) //nolint:goerr113
+	}
+
+	return nil
+}
+
+type stepJSON struct {
+	Term      json.RawMessage `json:"term"`
+	Roll      *Roll           `json:"roll,omitempty"`
+	Operation string          `json:"operation,omitempty"`
+	Value     string          `json:"value"`
+}
+
+func (step Step) MarshalJSON() ([]byte, error) {
+	term, err := json.Marshal(step.Term)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	return json.Marshal(stepJSON{Term: term, Roll: step.Roll, Operation: step.Operation, Value: step.Value}) //nolint:wrapcheck
+}
+
+func (step *Step) UnmarshalJSON(data []byte) error {
+	var encoded stepJSON
+
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidJSON, err)
+	}
+
+	term, err := UnmarshalTerm(encoded.Term)
+	if err != nil {
+		return err
+	}
+
+	*step = Step{Term: term, Roll: encoded.Roll, Operation: encoded.Operation, Value: encoded.Value}
+
+	return nil
+}
+
+func (comparison Comparison) MarshalText() ([]byte, error) {
+	return []byte(comparison.String()), nil
+}
+
+func (comparison *Comparison) UnmarshalText(text []byte) error {
+	for candidate := Equal; candidate <= GreaterEqual; candidate++ {
+		if candidate.String() == string(text) {
+			*comparison = candidate
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: unknown comparison %q", ErrInvalidJSON, text)
+}
+
+func (selection Selection) MarshalText() ([]byte, error) {
+	return []byte(selection.String()), nil
+}
+
+func (selection *Selection) UnmarshalText(text []byte) error {
+	for candidate := KeepHighest; candidate <= DropLowest; candidate++ {
+		if candidate.String() == string(text) {
+			*selection = candidate
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: unknown selection %q", ErrInvalidJSON, text)
+}
+
+func (critical Critical) MarshalText() ([]byte, error) {
+	return []byte(critical.String()), nil
+}
+
+func (critical *Critical) UnmarshalText(text []byte) error {
+	for candidate := NotCritical; candidate <= CriticalFailure; candidate++ {
+		if candidate.String() == string(text) {
+			*critical = candidate
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: unknown critical %q", ErrInvalidJSON, text)
+}
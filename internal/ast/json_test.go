@@ -0,0 +1,122 @@
+package ast_test
+
+import (
+	"encoding/json"
+	"flag"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/parser"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// Compare data to a golden file in testdata, or rewrite the file with -update.
+func assertGolden(t *testing.T, name string, data []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+
+	if *update {
+		assert.NoError(t, os.WriteFile(path, append(data, '\n'), 0o600))
+	}
+
+	golden, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, string(golden), string(data)+"\n", "%v should match its golden file", name)
+}
+
+func TestJSON(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse(`
+		attack = if(1d20cs>=19 + 5 >= 15, 2d6 [slashing] + (1d4)d6 [fire], 0) * 2 / 1
+		"Best of" = {2d6 + 1, d{-1, 0, 1:2}}kh1 - 4d6dl1cf1, {d20, d20}>=10 != 1
+	`)
+	assert.NoError(t, err)
+
+	data, err := json.MarshalIndent(formula, "", "\t")
+	assert.NoError(t, err)
+	assertGolden(t, "formula.json", data)
+
+	decoded := &ast.Formula{Equations: nil}
+	assert.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, formula, decoded)
+
+	// Integers too large for an int keep every digit.
+	var huge ast.Term = ast.BigIntTerm{Value: new(big.Int).Lsh(big.NewInt(1), 100)}
+
+	data, err = json.Marshal(huge)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"type":"int","value":1267650600228229401496703205376}`, string(data))
+
+	huge, err = ast.UnmarshalTerm(data)
+	assert.NoError(t, err)
+	assert.Equal(t, ast.BigIntTerm{Value: new(big.Int).Lsh(big.NewInt(1), 100)}, huge)
+
+	// Single-faced dice keep the results predictable.
+	results := ast.NewEvaluator().EvaluateFormula(&ast.Formula{Equations: []ast.Equation{
+		{Name: "damage", Term: ast.AddTerm{
+			Left:  ast.LabelTerm{Term: ast.CriticalTerm{Pool: ast.DiceTerm{Count: 2, Faces: 1}, Critical: ast.CriticalSuccess, Comparison: ast.Equal, Target: 1}, Label: "fire"},
+			Right: ast.KeepTerm{Pool: ast.GroupTerm{Members: []ast.Term{ast.IntTerm{Value: 3}, ast.IntTerm{Value: 7}}}, Selection: ast.KeepLowest, Count: 1},
+		}},
+		{Name: "", Term: ast.DivideTerm{Left: ast.IntTerm{Value: 1}, Right: ast.IntTerm{Value: 0}}},
+	}})
+
+	data, err = json.MarshalIndent(results, "", "\t")
+	assert.NoError(t, err)
+	assertGolden(t, "results.json", data)
+
+	decodedResults := []ast.Result{}
+	assert.NoError(t, json.Unmarshal(data, &decodedResults))
+	assert.Equal(t, results[0], decodedResults[0])
+	assert.EqualError(t, decodedResults[1].Err, ast.ErrDivisionByZero.Error())
+
+	// Traced results carry their steps.
+	evaluator := ast.NewEvaluator()
+	evaluator.Trace = true
+	traced := evaluator.EvaluateFormula(&ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.MultiplyTerm{Left: ast.DiceTerm{Count: 2, Faces: 1}, Right: ast.IntTerm{Value: 3}}},
+	}})
+
+	data, err = json.Marshal(traced[0])
+	assert.NoError(t, err)
+
+	decodedResult := ast.Result{}
+	assert.NoError(t, json.Unmarshal(data, &decodedResult))
+	assert.Len(t, decodedResult.Steps, 2)
+	assert.Equal(t, traced[0], decodedResult)
+
+	for _, invalid := range []string{
+		`{"type": "unknown"}`,
+		`{"type": "add", "left": {"type": "int", "value": 1}}`,
+		`{"type": "keep", "pool": {"type": "int", "value": 1}, "selection": "kh", "count": 1}`,
+		`{"type": "compare", "comparison": "=>", "left": {"type": "int", "value": 1}, "right": {"type": "int", "value": 1}}`,
+		`{"type": "int"}`,
+		`[]`,
+	} {
+		_, err := ast.UnmarshalTerm([]byte(invalid))
+		assert.ErrorIs(t, err, ast.ErrInvalidJSON, "%v should not decode", invalid)
+	}
+
+	// Custom faces that the parser rejects cannot be decoded either, since
+	// they cannot be rolled.
+	maxInt := strconv.Itoa(math.MaxInt)
+
+	for faces, expected := range map[string]string{
+		`[]`:                           "custom dice must have at least one face",
+		`[{"value": 3, "weight": 0}]`:  "face weights must be positive, got 0",
+		`[{"value": 3, "weight": -1}]`: "face weights must be positive, got -1",
+		`[{"value": 3}]`:               "face weights must be positive, got 0",
+		`[{"value": 1, "weight": ` + maxInt + `}, {"value": 2, "weight": 1}]`: "total weight of faces does not fit in an integer",
+	} {
+		_, err := ast.UnmarshalTerm([]byte(`{"type": "customDice", "count": 1, "faces": ` + faces + `}`))
+		assert.EqualError(t, err, "invalid formula JSON: "+expected, "%v should not decode", faces)
+	}
+}
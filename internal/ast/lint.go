@@ -0,0 +1,148 @@
+package ast
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+// Warning points at part of a formula that is valid but probably not what was
+// meant, such as 1d1.
+type Warning struct {
+	Span    token.Span
+	Message string
+}
+
+func (warning Warning) String() string {
+	return fmt.Sprintf("line %v column %v: %v", warning.Span.Start.Line, warning.Span.Start.Column, warning.Message)
+}
+
+// Lint returns warnings about suspicious parts of formula in the order they
+// appear. Lint the formula before optimizing it, since optimizing hides the
+// terms that were typed.
+func Lint(formula *Formula) []Warning {
+	warnings := []Warning{}
+	names := map[string]bool{}
+
+	for _, equation := range formula.Equations {
+		if equation.Name != "" {
+			if names[equation.Name] {
+				warnings = append(warnings, Warning{
+					Span:    equation.Span,
+					Message: fmt.Sprintf("%q is also the name of an earlier equation", equation.Name),
+				})
+			}
+
+			names[equation.Name] = true
+		}
+
+		Inspect(equation.Term, func(term Term) bool {
+			if message := lintTerm(term); message != "" {
+				warnings = append(warnings, Warning{Span: term.Source(), Message: message})
+			}
+
+			return true
+		})
+	}
+
+	sort.SliceStable(warnings, func(left, right int) bool {
+		return warnings[left].Span.Start.Offset < warnings[right].Span.Start.Offset
+	})
+
+	return warnings
+}
+
+// Return a warning about term alone, or an empty string if there is nothing
+// suspicious about it.
+func lintTerm(term Term) string {
+	switch term := term.(type) {
+	case DiceTerm:
+		switch {
+		case term.Count == 0:
+			return fmt.Sprintf("%v rolls no dice", term)
+		case term.Faces == 1 && term.Count > 0:
+			return fmt.Sprintf("%v always rolls %v", term, term.Count)
+		}
+	case CustomDiceTerm:
+		if term.Count == 0 {
+			return fmt.Sprintf("%v rolls no dice", term)
+		}
+	case DivideTerm:
+		if dividesToZero(term) {
+			return fmt.Sprintf("%v is always 0, since division drops the remainder", term)
+		}
+	case KeepTerm:
+		if keepsNothing(term) {
+			return fmt.Sprintf("%v drops every die", term)
+		}
+	case AttributeTerm:
+		if strings.HasPrefix(term.Name, "?{") {
+			return fmt.Sprintf("%v is read as 0, since it has no default answer", term)
+		}
+
+		return fmt.Sprintf("%v is read as 0, since there is no character sheet to read it from", term)
+	}
+
+	return ""
+}
+
+// Report whether the dividend of term is always smaller than its divisor.
+func dividesToZero(term DivideTerm) bool {
+	checker := boundsChecker{overflows: false}
+	left, right := checker.bounds(term.Left), checker.bounds(term.Right)
+
+	// Division by zero is an error rather than a warning.
+	if right.low.Sign() <= 0 && right.high.Sign() >= 0 {
+		return false
+	}
+
+	largestDividend := maxBig(new(big.Int).Abs(left.low), new(big.Int).Abs(left.high))
+	smallestDivisor := minBig(new(big.Int).Abs(right.low), new(big.Int).Abs(right.high))
+
+	return largestDividend.Cmp(smallestDivisor) < 0
+}
+
+// Report whether term drops every die of a pool that has any.
+func keepsNothing(term KeepTerm) bool {
+	size, isKnown := poolSize(term.Pool)
+	if isKnown && size == 0 {
+		return false
+	}
+
+	switch term.Selection {
+	case KeepHighest, KeepLowest:
+		return term.Count <= 0
+	case DropHighest, DropLowest:
+		return isKnown && term.Count >= size
+	default:
+		return false
+	}
+}
+
+// Return how many dice of pool are kept, if that is known before rolling.
+func poolSize(pool Pool) (int, bool) {
+	switch pool := pool.(type) {
+	case DiceTerm:
+		return max(pool.Count, 0), true
+	case CustomDiceTerm:
+		return max(pool.Count, 0), true
+	case GroupTerm:
+		return len(pool.Members), true
+	case CriticalTerm:
+		return poolSize(pool.Pool)
+	case KeepTerm:
+		size, isKnown := poolSize(pool.Pool)
+		count := min(max(pool.Count, 0), size)
+
+		if pool.Selection == KeepHighest || pool.Selection == KeepLowest {
+			return count, isKnown
+		}
+
+		return size - count, isKnown
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,50 @@
+package ast_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/parser"
+)
+
+func TestLint(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string][]string{
+		"1d20 + 5, {2d6, 1d8}kh1, 4d6dl3, 1d20 / 2, 10 / (1d4 - 1)": {},
+		"attack = 1d20 + 1d1, damage = 0d6 + 3d1": {
+			"line 1 column 17: 1d1 always rolls 1",
+			"line 1 column 31: 0d6 rolls no dice",
+			"line 1 column 37: 3d1 always rolls 3",
+		},
+		"1d6 / 10, 1 / 2, (2d4 + 3) / -12, 0d{1, 2}": {
+			"line 1 column 1: 1d6 / 10 is always 0, since division drops the remainder",
+			"line 1 column 11: 1 / 2 is always 0, since division drops the remainder",
+			"line 1 column 18: 2d4 + 3 / -12 is always 0, since division drops the remainder",
+			"line 1 column 35: 0d{1, 2} rolls no dice",
+		},
+		"2d20dl2, 1d20kh0 + 4d6dl1dh3, {1, 2}dh5": {
+			"line 1 column 1: 2d20dl2 drops every die",
+			"line 1 column 10: 1d20kh0 drops every die",
+			"line 1 column 20: 4d6dl1dh3 drops every die",
+			"line 1 column 31: {1, 2}dh5 drops every die",
+		},
+		"hit = 1d20, Hit = 1d20, hit = 2d20kh1": {
+			`line 1 column 25: "hit" is also the name of an earlier equation`,
+		},
+	}
+
+	for input, expected := range tests {
+		formula, err := parser.Parse(input)
+		assert.NoError(t, err, "%q should parse", input)
+
+		warnings := []string{}
+
+		for _, warning := range ast.Lint(formula) {
+			warnings = append(warnings, warning.String())
+		}
+
+		assert.Equal(t, expected, warnings, "%q should have the expected warnings", input)
+	}
+}
@@ -0,0 +1,147 @@
+package ast
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Mode decides what the dice of an evaluator roll.
+type Mode int
+
+const (
+	// Random rolls each die at random.
+	Random Mode = iota
+	// Average rolls each pool of dice as its average total, rounded and
+	// spread across its dice. Keeping or dropping selects from these dice
+	// rather than averaging over every possible roll, so only sums of dice
+	// are exact.
+	Average
+	// Maximum rolls the highest face of each die.
+	Maximum
+	// Minimum rolls the lowest face of each die.
+	Minimum
+)
+
+func (mode Mode) String() string {
+	switch mode {
+	case Random:
+		return "random"
+	case Average:
+		return "average"
+	case Maximum:
+		return "maximum"
+	case Minimum:
+		return "minimum"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(mode))
+	}
+}
+
+// Rounding decides how averages that fall between two whole numbers are
+// rounded.
+type Rounding int
+
+const (
+	// RoundDown rounds toward negative infinity, as monster stat blocks do.
+	RoundDown Rounding = iota
+	// RoundUp rounds toward positive infinity.
+	RoundUp
+	// RoundNearest rounds to the nearest whole number, with halves rounded
+	// up.
+	RoundNearest
+)
+
+func (rounding Rounding) String() string {
+	switch rounding {
+	case RoundDown:
+		return "rounded down"
+	case RoundUp:
+		return "rounded up"
+	case RoundNearest:
+		return "rounded to nearest"
+	default:
+		return fmt.Sprintf("Rounding(%d)", int(rounding))
+	}
+}
+
+func (rounding Rounding) round(value *big.Rat) *big.Int {
+	numerator, denominator := value.Num(), value.Denom()
+
+	// Euclidean division rounds down since the denominator is positive.
+	switch rounding {
+	case RoundUp:
+		negated := new(big.Int).Neg(numerator)
+
+		return negated.Neg(negated.Div(negated, denominator))
+	case RoundNearest:
+		doubled := new(big.Int).Lsh(numerator, 1)
+
+		return doubled.Div(doubled.Add(doubled, denominator), new(big.Int).Lsh(denominator, 1))
+	default:
+		return new(big.Int).Div(numerator, denominator)
+	}
+}
+
+// Return count dice that roll faces from low to high with the given mean,
+// following the mode of the evaluator rather than chance. Sampled pools count
+// the dice that roll each value, as they do when rolled at random.
+func (evaluator *Evaluator) fixedDice(count, low, high int, mean *big.Rat, sampled bool) []Die {
+	if count == 0 {
+		return []Die{}
+	}
+
+	// Every die rolls the same value, or one more to make up the remainder,
+	// so each stays between low and high.
+	value, remainder := high, 0
+
+	switch evaluator.Mode { //nolint:exhaustive
+	case Minimum:
+		value = low
+	case Average:
+		total := evaluator.Rounding.round(new(big.Rat).Mul(mean, new(big.Rat).SetInt64(int64(count))))
+		quotient, modulus := new(big.Int).DivMod(total, big.NewInt(int64(count)), new(big.Int))
+		value, remainder = int(quotient.Int64()), int(modulus.Int64())
+	}
+
+	if sampled {
+		dice := []Die{}
+
+		if remainder > 0 {
+			dice = append(dice, Die{Value: value + 1, Dropped: false, Critical: NotCritical, Count: remainder})
+		}
+
+		if remainder < count {
+			dice = append(dice, Die{Value: value, Dropped: false, Critical: NotCritical, Count: count - remainder})
+		}
+
+		return dice
+	}
+
+	dice := make([]Die, count)
+
+	for index := range dice {
+		dice[index] = Die{Value: value, Dropped: false, Critical: NotCritical, Count: 0}
+
+		if index < remainder {
+			dice[index].Value++
+		}
+	}
+
+	return dice
+}
+
+// Return the lowest face, the highest face and the mean value of a custom die.
+func faceRange(faces []Face) (int, int, *big.Rat) {
+	low, high := faces[0].Value, faces[0].Value
+	sum, totalWeight := new(big.Int), new(big.Int)
+
+	for _, face := range faces {
+		low, high = min(low, face.Value), max(high, face.Value)
+
+		weight := big.NewInt(int64(face.Weight))
+		totalWeight.Add(totalWeight, weight)
+		sum.Add(sum, weight.Mul(weight, big.NewInt(int64(face.Value))))
+	}
+
+	return low, high, new(big.Rat).SetFrac(sum, totalWeight)
+}
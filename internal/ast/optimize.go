@@ -0,0 +1,319 @@
+package ast
+
+import (
+	"math"
+	"math/big"
+
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+// Optimize returns a copy of formula with constant terms folded, like dice
+// merged and identities such as "* 1" removed. The optimized formula has the
+// same distribution, labels and errors as the original, but rolls fewer
+// separate dice terms.
+func Optimize(formula *Formula) *Formula {
+	return OptimizeMode(formula, Random)
+}
+
+// OptimizeMode is like Optimize for a formula evaluated in mode. Modes other
+// than Random round the average of each pool, so like dice are not merged for
+// them.
+func OptimizeMode(formula *Formula, mode Mode) *Formula {
+	optimizer := optimizer{mergesDice: mode == Random}
+	equations := make([]Equation, 0, len(formula.Equations))
+
+	for _, equation := range formula.Equations {
+		equations = append(equations, Equation{
+			Name:    equation.Name,
+			Term:    optimizer.optimize(equation.Term),
+			Span:    equation.Span,
+			Ordinal: equation.Ordinal,
+		})
+	}
+
+	return &Formula{Equations: equations}
+}
+
+type optimizer struct {
+	// Set to merge dice with the same faces, such as 1d6 + 2d6 into 3d6.
+	mergesDice bool
+}
+
+// OptimizeTerm returns an optimized copy of term. Pools stay pools.
+func OptimizeTerm(term Term) Term {
+	return optimizer{mergesDice: true}.optimize(term)
+}
+
+//nolint:cyclop,funlen
+func (optimizer optimizer) optimize(term Term) Term {
+	switch term := term.(type) {
+	case CompareTerm:
+		term.Left, term.Right = optimizer.optimize(term.Left), optimizer.optimize(term.Right)
+
+		if left, right, isConstant := constants(term.Left, term.Right); isConstant {
+			value := 0
+			if term.Comparison.Compare(left, right) {
+				value = 1
+			}
+
+			return IntTerm{Value: value, Span: term.Span}
+		}
+
+		return term
+	case ConditionalTerm:
+		term.Condition = optimizer.optimize(term.Condition)
+
+		// The branch that is not taken is never rolled anyway.
+		if condition, isConstant := term.Condition.(IntTerm); isConstant {
+			if condition.Value != 0 {
+				return optimizer.optimize(term.Then)
+			}
+
+			return optimizer.optimize(term.Else)
+		}
+
+		term.Then, term.Else = optimizer.optimize(term.Then), optimizer.optimize(term.Else)
+
+		return term
+	case MultiplyTerm:
+		term.Left, term.Right = optimizer.optimize(term.Left), optimizer.optimize(term.Right)
+
+		if left, right, isConstant := constants(term.Left, term.Right); isConstant {
+			// Products that overflow are left for the evaluator to
+			// compute with arbitrary precision.
+			if product, fits := multiplyInt(left, right); fits {
+				return IntTerm{Value: product, Span: term.Span}
+			}
+		}
+
+		if isInt(term.Left, 1) {
+			return term.Right
+		}
+
+		if isInt(term.Right, 1) {
+			return term.Left
+		}
+
+		return term
+	case DivideTerm:
+		term.Left, term.Right = optimizer.optimize(term.Left), optimizer.optimize(term.Right)
+
+		// Division by zero is left for the evaluator to report, and the
+		// one quotient that overflows for it to compute.
+		left, right, isConstant := constants(term.Left, term.Right)
+		if isConstant && right != 0 && (right != -1 || left != math.MinInt) {
+			return IntTerm{Value: left / right, Span: term.Span}
+		}
+
+		if isInt(term.Right, 1) {
+			return term.Left
+		}
+
+		return term
+	case AddTerm, SubtractTerm:
+		return optimizer.optimizeSum(term)
+	case DynamicDiceTerm:
+		term.Count, term.Faces = optimizer.optimize(term.Count), optimizer.optimize(term.Faces)
+
+		if count, faces, isConstant := constants(term.Count, term.Faces); isConstant {
+			return DiceTerm{Count: count, Faces: faces, Span: term.Span}
+		}
+
+		return term
+	case LabelTerm:
+		term.Term = optimizer.optimize(term.Term)
+
+		return term
+	case GroupTerm:
+		members := make([]Term, 0, len(term.Members))
+
+		for _, member := range term.Members {
+			members = append(members, optimizer.optimize(member))
+		}
+
+		term.Members = members
+
+		return term
+	case KeepTerm:
+		term.Pool = optimizer.optimizePool(term.Pool)
+
+		return term
+	case SuccessTerm:
+		term.Pool = optimizer.optimizePool(term.Pool)
+
+		return term
+	case CriticalTerm:
+		term.Pool = optimizer.optimizePool(term.Pool)
+
+		return term
+	default:
+		return term
+	}
+}
+
+func (optimizer optimizer) optimizePool(pool Pool) Pool {
+	//nolint:forcetypeassert
+	return optimizer.optimize(pool).(Pool)
+}
+
+// Return the values of left and right if both are integers.
+func constants(left, right Term) (int, int, bool) {
+	leftInt, isLeftInt := left.(IntTerm)
+	rightInt, isRightInt := right.(IntTerm)
+
+	return leftInt.Value, rightInt.Value, isLeftInt && isRightInt
+}
+
+func isInt(term Term, value int) bool {
+	intTerm, isInt := term.(IntTerm)
+
+	return isInt && intTerm.Value == value
+}
+
+// A term that is added to or, when negative, subtracted from a sum.
+type summand struct {
+	term     Term
+	negative bool
+}
+
+// Flatten a chain of additions and subtractions, sum its integers and merge
+// dice with the same faces, such as 1d6 + 2 + 2d6 - 1 into 3d6 + 1. Labelled
+// terms are kept apart so that their subtotals do not change.
+func (optimizer optimizer) optimizeSum(term Term) Term {
+	constant := new(big.Int)
+	summands := []summand{}
+
+	for _, current := range optimizer.flattenSum(term, false, nil) {
+		switch currentTerm := current.term.(type) {
+		case IntTerm:
+			addConstant(constant, big.NewInt(int64(currentTerm.Value)), current.negative)
+
+			continue
+		case BigIntTerm:
+			addConstant(constant, currentTerm.Value, current.negative)
+
+			continue
+		case DiceTerm:
+			if optimizer.mergesDice && mergeDice(summands, current) {
+				continue
+			}
+		}
+
+		summands = append(summands, current)
+	}
+
+	if len(summands) == 0 {
+		return NewIntTerm(constant, term.Source())
+	}
+
+	// Lead with the integer when the first term is subtracted.
+	sum := NewIntTerm(constant, token.Span{})
+
+	if !summands[0].negative {
+		sum = summands[0].term
+		summands = summands[1:]
+
+		if constant.Sign() != 0 {
+			summands = append(summands, summand{
+				term:     NewIntTerm(new(big.Int).Abs(constant), token.Span{}),
+				negative: constant.Sign() < 0,
+			})
+		}
+	}
+
+	for _, current := range summands {
+		span := joinSpans(sum.Source(), current.term.Source())
+
+		if current.negative {
+			sum = SubtractTerm{Left: sum, Right: current.term, Span: span}
+		} else {
+			sum = AddTerm{Left: sum, Right: current.term, Span: span}
+		}
+	}
+
+	return sum
+}
+
+// Add value to constant, or subtract it when negative.
+func addConstant(constant, value *big.Int, negative bool) {
+	if negative {
+		constant.Sub(constant, value)
+	} else {
+		constant.Add(constant, value)
+	}
+}
+
+// Return the optimized terms of a chain of additions and subtractions in the
+// order they are evaluated.
+func (optimizer optimizer) flattenSum(term Term, negative bool, summands []summand) []summand {
+	switch term := term.(type) {
+	case AddTerm:
+		summands = optimizer.flattenSum(term.Left, negative, summands)
+
+		return optimizer.flattenSum(term.Right, negative, summands)
+	case SubtractTerm:
+		summands = optimizer.flattenSum(term.Left, negative, summands)
+
+		return optimizer.flattenSum(term.Right, !negative, summands)
+	default:
+		optimized := optimizer.optimize(term)
+
+		// A conditional may optimize to a sum of its own.
+		switch optimized.(type) {
+		case AddTerm, SubtractTerm:
+			return optimizer.flattenSum(optimized, negative, summands)
+		default:
+			return append(summands, summand{term: optimized, negative: negative})
+		}
+	}
+}
+
+// Add the dice of current to a summand with the same faces and sign, and report
+// whether there was one.
+func mergeDice(summands []summand, current summand) bool {
+	diceTerm, _ := current.term.(DiceTerm)
+	if diceTerm.Count < 0 {
+		return false
+	}
+
+	for index, other := range summands {
+		otherDice, isDice := other.term.(DiceTerm)
+
+		if isDice && other.negative == current.negative && otherDice.Faces == diceTerm.Faces && otherDice.Count >= 0 {
+			count, fits := addInt(otherDice.Count, diceTerm.Count)
+			if !fits {
+				return false
+			}
+
+			otherDice.Count = count
+			otherDice.Span = joinSpans(otherDice.Span, diceTerm.Span)
+			summands[index].term = otherDice
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the span covering both left and right, ignoring zero spans.
+func joinSpans(left, right token.Span) token.Span {
+	switch {
+	case left == token.Span{}:
+		return right
+	case right == token.Span{}:
+		return left
+	}
+
+	start, end := left.Start, left.End
+
+	if right.Start.Offset < start.Offset {
+		start = right.Start
+	}
+
+	if right.End.Offset > end.Offset {
+		end = right.End
+	}
+
+	return token.Span{Start: start, End: end}
+}
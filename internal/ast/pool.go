@@ -0,0 +1,311 @@
+package ast
+
+import (
+	"slices"
+	"sort"
+
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+// Pool is a term made up of several values, such as the dice of a dice term or
+// the members of a group, that modifiers like keep/drop can select from.
+type Pool interface {
+	Term
+	Roll(evaluator *Evaluator) (Roll, error)
+}
+
+// Roll records the values of a pool so that they can be shown to the user.
+type Roll struct {
+	// Group is set when each die is the subtotal of a group member.
+	Group bool  `json:"group"`
+	Dice  []Die `json:"dice"`
+}
+
+type Die struct {
+	Value    int      `json:"value"`
+	Dropped  bool     `json:"dropped"`
+	Critical Critical `json:"critical"`
+	// Count is how many dice rolled the value in a pool that was sampled,
+	// which records each value once rather than each die. It is 0 for a
+	// single die.
+	Count int `json:"count,omitempty"`
+}
+
+// Times returns how many dice rolled the value.
+func (die Die) Times() int {
+	return max(die.Count, 1)
+}
+
+type Critical int
+
+const (
+	NotCritical Critical = iota
+	CriticalSuccess
+	CriticalFailure
+)
+
+// Critical reports whether any die that was not dropped is a critical success
+// or failure.
+func (roll Roll) Critical() (bool, bool) {
+	success, failure := false, false
+
+	for _, die := range roll.Dice {
+		if !die.Dropped {
+			success = success || die.Critical == CriticalSuccess
+			failure = failure || die.Critical == CriticalFailure
+		}
+	}
+
+	return success, failure
+}
+
+// Total sums the dice that were not dropped.
+func (roll Roll) Total() int {
+	total := 0
+
+	for _, die := range roll.Dice {
+		if !die.Dropped {
+			total += die.Value * die.Times()
+		}
+	}
+
+	return total
+}
+
+// Size counts the dice of the roll, including dropped dice.
+func (roll Roll) Size() int {
+	size := 0
+
+	for _, die := range roll.Dice {
+		size += die.Times()
+	}
+
+	return size
+}
+
+// Roll a pool, record the result on the evaluator and return the total.
+func evaluatePool(evaluator *Evaluator, pool Pool) (int, error) {
+	roll, err := pool.Roll(evaluator)
+	if err != nil {
+		return 0, err
+	}
+
+	evaluator.rolls = append(evaluator.rolls, roll)
+
+	if evaluator.Trace {
+		evaluator.traceRoll(pool, roll, roll.Total())
+	}
+
+	return roll.Total(), nil
+}
+
+// KeepD20 returns a copy of term with its first 1d20 replaced by count d20s of
+// which one is kept, as when rolling with advantage or disadvantage, and reports
+// whether term rolls a 1d20.
+func KeepD20(term Term, count int, selection Selection) (Term, bool) {
+	return ReplaceFirst(term, func(term Term) (Term, bool) {
+		diceTerm, isDice := term.(DiceTerm)
+		if !isDice || diceTerm.Count != 1 || diceTerm.Faces != 20 { //nolint:gomnd
+			return nil, false
+		}
+
+		diceTerm.Count = count
+
+		return KeepTerm{Pool: diceTerm, Selection: selection, Count: 1, Span: diceTerm.Span}, true
+	})
+}
+
+// GroupTerm is a pool whose values are the subtotals of each of its members,
+// such as {2d6+1, 1d12}.
+type GroupTerm struct {
+	Members []Term
+	Span    token.Span
+}
+
+func (groupTerm GroupTerm) Solve() int { return solve(groupTerm) }
+
+func (groupTerm GroupTerm) Source() token.Span { return groupTerm.Span }
+
+func (groupTerm GroupTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	return evaluatePool(evaluator, groupTerm)
+}
+
+func (groupTerm GroupTerm) Roll(evaluator *Evaluator) (Roll, error) {
+	roll := Roll{Group: true, Dice: make([]Die, 0, len(groupTerm.Members))}
+
+	for _, member := range groupTerm.Members {
+		value, err := member.Evaluate(evaluator)
+		if err != nil {
+			return Roll{}, err
+		}
+
+		roll.Dice = append(roll.Dice, Die{Value: value, Dropped: false, Critical: NotCritical, Count: 0})
+	}
+
+	return roll, nil
+}
+
+type Selection int
+
+const (
+	KeepHighest Selection = iota
+	KeepLowest
+	DropHighest
+	DropLowest
+)
+
+// KeepTerm drops values from a pool, such as 2d20kh1 which keeps the highest
+// of two d20s. Values dropped by an inner pool stay dropped.
+type KeepTerm struct {
+	Pool      Pool
+	Selection Selection
+	Count     int
+	Span      token.Span
+}
+
+func (keepTerm KeepTerm) Solve() int { return solve(keepTerm) }
+
+func (keepTerm KeepTerm) Source() token.Span { return keepTerm.Span }
+
+func (keepTerm KeepTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	return evaluatePool(evaluator, keepTerm)
+}
+
+func (keepTerm KeepTerm) Roll(evaluator *Evaluator) (Roll, error) {
+	roll, err := keepTerm.Pool.Roll(evaluator)
+	if err != nil {
+		return Roll{}, err
+	}
+
+	// Sort the indexes of the remaining dice from highest to lowest.
+	indexes := []int{}
+	remaining := 0
+
+	for index, die := range roll.Dice {
+		if !die.Dropped {
+			indexes = append(indexes, index)
+			remaining += die.Times()
+		}
+	}
+
+	sort.SliceStable(indexes, func(left, right int) bool {
+		return roll.Dice[indexes[left]].Value > roll.Dice[indexes[right]].Value
+	})
+
+	count := min(max(keepTerm.Count, 0), remaining)
+
+	// Keeping some dice drops the rest from the other end of the pool.
+	if keepTerm.Selection == KeepHighest || keepTerm.Selection == KeepLowest {
+		count = remaining - count
+	}
+
+	if keepTerm.Selection == KeepHighest || keepTerm.Selection == DropLowest {
+		slices.Reverse(indexes)
+	}
+
+	return roll.drop(indexes, count), nil
+}
+
+// Drop count dice from the dice at indexes in order. A sampled value that is
+// only partly dropped is split in two, so the roll is copied rather than
+// modified.
+func (roll Roll) drop(indexes []int, count int) Roll {
+	dropped := make([]int, len(roll.Dice))
+
+	for _, index := range indexes {
+		if count == 0 {
+			break
+		}
+
+		dropped[index] = min(roll.Dice[index].Times(), count)
+		count -= dropped[index]
+	}
+
+	dice := make([]Die, 0, len(roll.Dice))
+
+	for index, die := range roll.Dice {
+		switch dropped[index] {
+		case 0:
+			dice = append(dice, die)
+		case die.Times():
+			die.Dropped = true
+			dice = append(dice, die)
+		default:
+			kept := die
+			kept.Count -= dropped[index]
+			die.Dropped, die.Count = true, dropped[index]
+			dice = append(dice, kept, die)
+		}
+	}
+
+	return Roll{Group: roll.Group, Dice: dice}
+}
+
+// SuccessTerm counts the values of a pool that satisfy a comparison, such as
+// {1d20+5, 1d20+5}>=15.
+type SuccessTerm struct {
+	Pool       Pool
+	Comparison Comparison
+	Target     int
+	Span       token.Span
+}
+
+func (successTerm SuccessTerm) Solve() int { return solve(successTerm) }
+
+func (successTerm SuccessTerm) Source() token.Span { return successTerm.Span }
+
+func (successTerm SuccessTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	roll, err := successTerm.Pool.Roll(evaluator)
+	if err != nil {
+		return 0, err
+	}
+
+	evaluator.rolls = append(evaluator.rolls, roll)
+
+	successes := 0
+
+	for _, die := range roll.Dice {
+		if !die.Dropped && successTerm.Comparison.Compare(die.Value, successTerm.Target) {
+			successes += die.Times()
+		}
+	}
+
+	if evaluator.Trace {
+		evaluator.traceRoll(successTerm, roll, successes)
+	}
+
+	return successes, nil
+}
+
+// CriticalTerm marks the values of a pool that satisfy a comparison as critical
+// without changing its total, such as 1d20cs>=19.
+type CriticalTerm struct {
+	Pool       Pool
+	Critical   Critical
+	Comparison Comparison
+	Target     int
+	Span       token.Span
+}
+
+func (critTerm CriticalTerm) Solve() int { return solve(critTerm) }
+
+func (critTerm CriticalTerm) Source() token.Span { return critTerm.Span }
+
+func (critTerm CriticalTerm) Evaluate(evaluator *Evaluator) (int, error) {
+	return evaluatePool(evaluator, critTerm)
+}
+
+func (critTerm CriticalTerm) Roll(evaluator *Evaluator) (Roll, error) {
+	roll, err := critTerm.Pool.Roll(evaluator)
+	if err != nil {
+		return Roll{}, err
+	}
+
+	for index, die := range roll.Dice {
+		if critTerm.Comparison.Compare(die.Value, critTerm.Target) {
+			roll.Dice[index].Critical = critTerm.Critical
+		}
+	}
+
+	return roll, nil
+}
@@ -0,0 +1,178 @@
+package ast
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Rolling dice one at a time costs a random number per die, so pools with far
+// more dice than faces instead draw how many dice land on each face. In
+// BenchmarkDice sampling overtakes rolling each die at around 64d6, 256d20 and
+// 1024d100.
+const (
+	sampleRatio   = 12
+	sampleMinimum = 64
+	// Binomials with fewer expected successes than this are drawn by
+	// inversion rather than split further.
+	inversionLimit = 16
+)
+
+// ShouldSample reports whether count dice with the given faces are rolled
+// faster with SampleFaces than one at a time.
+func ShouldSample(count, faces int) bool {
+	return count >= sampleMinimum && count/sampleRatio >= faces
+}
+
+// SampleFaces sets counts[i] to the number of dice that rolled i+1 out of
+// count dice with len(counts) faces. The counts have exactly the distribution
+// of rolling each die, but take time in proportion to the faces rather than
+// the dice.
+func SampleFaces(counts []int, count int) {
+	remaining := count
+
+	for index := range counts {
+		// Each remaining die is equally likely to land on any face not
+		// yet counted.
+		if index == len(counts)-1 {
+			counts[index] = remaining
+		} else {
+			counts[index] = binomial(remaining, 1/float64(len(counts)-index))
+		}
+
+		remaining -= counts[index]
+	}
+}
+
+// SampleWeightedFaces is like SampleFaces for custom faces, which are rolled
+// in proportion to their weights.
+func SampleWeightedFaces(counts []int, count int, faces []Face) {
+	remaining := count
+	remainingWeight := 0.0
+
+	for _, face := range faces {
+		remainingWeight += float64(face.Weight)
+	}
+
+	for index, face := range faces {
+		if index == len(faces)-1 {
+			counts[index] = remaining
+		} else {
+			counts[index] = binomial(remaining, float64(face.Weight)/remainingWeight)
+		}
+
+		remaining -= counts[index]
+		remainingWeight -= float64(face.Weight)
+	}
+}
+
+// Roll count dice with the given faces by sampling. Each value rolled is
+// recorded once with the number of dice that rolled it, in ascending order.
+func sampleDice(count, faces int) []Die {
+	counts := make([]int, faces)
+	SampleFaces(counts, count)
+
+	return countedDice(counts, func(index int) int { return index + 1 })
+}
+
+// Roll count custom dice by sampling, with the values in the order of the
+// faces.
+func sampleCustomDice(count int, faces []Face) []Die {
+	counts := make([]int, len(faces))
+	SampleWeightedFaces(counts, count, faces)
+
+	return countedDice(counts, func(index int) int { return faces[index].Value })
+}
+
+// Return a die for each face rolled at least once, counting the dice that
+// rolled it.
+func countedDice(counts []int, value func(index int) int) []Die {
+	dice := []Die{}
+
+	for index, facesRolled := range counts {
+		if facesRolled > 0 {
+			dice = append(dice, Die{Value: value(index), Dropped: false, Critical: NotCritical, Count: facesRolled})
+		}
+	}
+
+	return dice
+}
+
+// Return the number of successes in trials that each succeed with the given
+// probability.
+func binomial(trials int, probability float64) int {
+	switch {
+	case trials <= 0 || probability <= 0:
+		return 0
+	case probability >= 1:
+		return trials
+	case probability > 0.5: //nolint:gomnd
+		return trials - binomial(trials, 1-probability)
+	case float64(trials)*probability < inversionLimit:
+		return binomialInversion(trials, probability)
+	}
+
+	// Draw the median of the uniform variables behind each trial, then
+	// count the successes on the side of the median that straddles the
+	// probability (Knuth, TAOCP volume 2, 3.4.1).
+	below := trials/2 + 1
+	above := trials + 1 - below
+	median := beta(float64(below), float64(above))
+
+	if median >= probability {
+		return binomial(below-1, probability/median)
+	}
+
+	return below + binomial(above-1, (probability-median)/(1-median))
+}
+
+// Draw a binomial by walking its cumulative distribution, which takes time in
+// proportion to the expected number of successes.
+func binomialInversion(trials int, probability float64) int {
+	ratio := probability / (1 - probability)
+
+	for {
+		pick := rand.Float64() //nolint:gosec
+		chance := math.Pow(1-probability, float64(trials))
+
+		for successes := 0; successes <= trials; successes++ {
+			if pick < chance {
+				return successes
+			}
+
+			pick -= chance
+			chance *= ratio * float64(trials-successes) / float64(successes+1)
+		}
+
+		// Rounding left a sliver of the distribution uncovered.
+	}
+}
+
+// Draw from a beta distribution with shapes of at least 1.
+func beta(alpha, beta float64) float64 {
+	left, right := gamma(alpha), gamma(beta)
+
+	return left / (left + right)
+}
+
+// Draw from a gamma distribution with a shape of at least 1 (Marsaglia and
+// Tsang, 2000).
+func gamma(shape float64) float64 {
+	scale := shape - 1.0/3           //nolint:gomnd
+	spread := 1 / math.Sqrt(9*scale) //nolint:gomnd
+
+	for {
+		normal := rand.NormFloat64() //nolint:gosec
+		cube := 1 + spread*normal
+
+		if cube <= 0 {
+			continue
+		}
+
+		cube = cube * cube * cube
+		pick := rand.Float64() //nolint:gosec
+
+		if math.Log(pick) < normal*normal/2+scale-scale*cube+scale*math.Log(cube) {
+			return scale * cube
+		}
+	}
+}
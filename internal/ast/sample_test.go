@@ -0,0 +1,173 @@
+package ast_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/parser"
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+func TestSampleFaces(t *testing.T) {
+	t.Parallel()
+
+	const samples = 20000
+
+	// The number of twos out of 200d2 follows a binomial with a mean of 100
+	// and a variance of 50.
+	counts := make([]int, 2)
+	sum, squares := 0.0, 0.0
+
+	for sample := 0; sample < samples; sample++ {
+		ast.SampleFaces(counts, 200)
+		assert.Equal(t, 200, counts[0]+counts[1])
+
+		sum += float64(counts[1])
+		squares += float64(counts[1] * counts[1])
+	}
+
+	mean := sum / samples
+	assert.InDelta(t, 100, mean, 0.2)
+	assert.InDelta(t, 50, squares/samples-mean*mean, 2.5)
+
+	// Sums of huge pools keep the mean and variance of rolling each die.
+	limits := ast.Limits{MaxDice: 100, MaxFaces: 20, MaxSampledDice: 100000}
+	sum, squares = 0, 0
+
+	for sample := 0; sample < 2000; sample++ {
+		evaluator := ast.NewEvaluator()
+		evaluator.Limits = limits
+
+		value, err := ast.DiceTerm{Count: 10000, Faces: 6}.Evaluate(evaluator)
+		assert.NoError(t, err)
+
+		sum += float64(value)
+		squares += float64(value) * float64(value)
+	}
+
+	mean = sum / 2000
+	assert.InDelta(t, 35000, mean, 15)
+	assert.InDelta(t, 10000*35.0/12, squares/2000-mean*mean, 10000*35.0/12*0.15)
+
+	// Dice that are sampled can still be kept and dropped.
+	evaluator := ast.NewEvaluator()
+	evaluator.Limits = limits
+
+	value, err := ast.KeepTerm{
+		Pool:      ast.DiceTerm{Count: 1000, Faces: 2},
+		Selection: ast.KeepLowest,
+		Count:     10,
+	}.Evaluate(evaluator)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, value)
+}
+
+func TestSampledPoolAllocations(t *testing.T) {
+	// Sampled pools count the dice that rolled each value, so even huge
+	// pools take a handful of allocations.
+	formula, err := parser.Parse("10000000d6, 10000000d{-1, 0, 1}")
+	assert.NoError(t, err)
+
+	var results []ast.Result
+
+	allocations := testing.AllocsPerRun(10, func() {
+		results = ast.NewEvaluator().EvaluateFormula(formula)
+	})
+	assert.Less(t, allocations, 50.0)
+
+	assert.NoError(t, results[0].Err)
+	assert.True(t, 10000000 <= results[0].Value && results[0].Value <= 60000000)
+	assert.LessOrEqual(t, len(results[0].Rolls[0].Dice), 6)
+	assert.Equal(t, 10000000, results[0].Rolls[0].Size())
+
+	assert.NoError(t, results[1].Err)
+	assert.True(t, -10000000 <= results[1].Value && results[1].Value <= 10000000)
+	assert.Equal(t, 10000000, results[1].Rolls[0].Size())
+}
+
+func TestSampledPools(t *testing.T) {
+	t.Parallel()
+
+	// Keeping and dropping splits the counts of values that are partly
+	// dropped.
+	roll, err := ast.KeepTerm{
+		Pool:      ast.DiceTerm{Count: 10000000, Faces: 2},
+		Selection: ast.KeepLowest,
+		Count:     10,
+	}.Roll(ast.NewEvaluator())
+	assert.NoError(t, err)
+	assert.Equal(t, 10, roll.Total())
+	assert.Equal(t, 10000000, roll.Size())
+	assert.Equal(t, ast.Die{Value: 1, Dropped: false, Critical: ast.NotCritical, Count: 10}, roll.Dice[0])
+
+	value, err := ast.SuccessTerm{
+		Pool:       ast.KeepTerm{Pool: ast.DiceTerm{Count: 10000000, Faces: 6}, Selection: ast.DropLowest, Count: 9999990},
+		Comparison: ast.Equal,
+		Target:     6,
+		Span:       token.Span{},
+	}.Evaluate(ast.NewEvaluator())
+	assert.NoError(t, err)
+	assert.Equal(t, 10, value)
+
+	// Averages of sampled pools are counted the same way.
+	evaluator := ast.NewEvaluator()
+	evaluator.Mode = ast.Average
+
+	roll, err = ast.DiceTerm{Count: 10000001, Faces: 6}.Roll(evaluator)
+	assert.NoError(t, err)
+	assert.Equal(t, 35000003, roll.Total())
+	assert.Len(t, roll.Dice, 2)
+
+	// Sampled pools cost as many dice as they have faces, up to a limit on
+	// their size.
+	evaluator = ast.NewEvaluator()
+	evaluator.Limits = ast.Limits{MaxDice: 10, MaxFaces: 6, MaxSampledDice: 1000}
+
+	_, err = ast.AddTerm{Left: ast.DiceTerm{Count: 1000, Faces: 6}, Right: ast.DiceTerm{Count: 4, Faces: 6}}.Evaluate(evaluator)
+	assert.NoError(t, err)
+
+	_, err = ast.DiceTerm{Count: 1001, Faces: 6}.Evaluate(ast.NewEvaluator())
+	assert.NoError(t, err)
+
+	_, err = ast.DiceTerm{Count: 1001, Faces: 6}.Evaluate(evaluator)
+	assert.ErrorIs(t, err, ast.ErrTooManyDice)
+	assert.EqualError(t, err, "too many dice: cannot roll more than 1000 dice at once")
+}
+
+// Compare rolling each die to sampling the faces to find where sampling
+// becomes faster.
+func BenchmarkDice(b *testing.B) {
+	for _, faces := range []int{6, 20, 100} {
+		for _, count := range []int{16, 64, 256, 1024, 16384} {
+			b.Run(fmt.Sprintf("%vd%v/each", count, faces), func(b *testing.B) {
+				for iteration := 0; iteration < b.N; iteration++ {
+					total := 0
+
+					for index := 0; index < count; index++ {
+						total += rand.Intn(faces) + 1 //nolint:gosec
+					}
+				}
+			})
+
+			b.Run(fmt.Sprintf("%vd%v/sampled", count, faces), func(b *testing.B) {
+				counts := make([]int, faces)
+
+				for iteration := 0; iteration < b.N; iteration++ {
+					ast.SampleFaces(counts, count)
+				}
+			})
+		}
+	}
+
+	b.Run("2147483647d6/sampled", func(b *testing.B) {
+		counts := make([]int, 6)
+
+		for iteration := 0; iteration < b.N; iteration++ {
+			ast.SampleFaces(counts, math.MaxInt32)
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package ast
+
+import "meganruggiero.com/dicebot/internal/token"
+
+// WithoutSpans returns a copy of formula with every span and ordinal set to
+// zero, so that formulas can be compared by structure alone.
+func WithoutSpans(formula *Formula) *Formula {
+	equations := make([]Equation, 0, len(formula.Equations))
+
+	for _, equation := range formula.Equations {
+		equations = append(equations, Equation{
+			Name:    equation.Name,
+			Term:    TermWithoutSpans(equation.Term),
+			Span:    token.Span{},
+			Ordinal: 0,
+		})
+	}
+
+	return &Formula{Equations: equations}
+}
+
+// TermWithoutSpans returns a copy of term with every span set to zero.
+//
+//nolint:cyclop,funlen
+func TermWithoutSpans(term Term) Term {
+	switch term := term.(type) {
+	case CompareTerm:
+		term.Left, term.Right, term.Span = TermWithoutSpans(term.Left), TermWithoutSpans(term.Right), token.Span{}
+
+		return term
+	case ConditionalTerm:
+		term.Condition = TermWithoutSpans(term.Condition)
+		term.Then, term.Else, term.Span = TermWithoutSpans(term.Then), TermWithoutSpans(term.Else), token.Span{}
+
+		return term
+	case MultiplyTerm:
+		term.Left, term.Right, term.Span = TermWithoutSpans(term.Left), TermWithoutSpans(term.Right), token.Span{}
+
+		return term
+	case DivideTerm:
+		term.Left, term.Right, term.Span = TermWithoutSpans(term.Left), TermWithoutSpans(term.Right), token.Span{}
+
+		return term
+	case AddTerm:
+		term.Left, term.Right, term.Span = TermWithoutSpans(term.Left), TermWithoutSpans(term.Right), token.Span{}
+
+		return term
+	case SubtractTerm:
+		term.Left, term.Right, term.Span = TermWithoutSpans(term.Left), TermWithoutSpans(term.Right), token.Span{}
+
+		return term
+	case DiceTerm:
+		term.Span = token.Span{}
+
+		return term
+	case DynamicDiceTerm:
+		term.Count, term.Faces, term.Span = TermWithoutSpans(term.Count), TermWithoutSpans(term.Faces), token.Span{}
+
+		return term
+	case CustomDiceTerm:
+		term.Span = token.Span{}
+
+		return term
+	case LabelTerm:
+		term.Term, term.Span = TermWithoutSpans(term.Term), token.Span{}
+
+		return term
+	case IntTerm:
+		term.Span = token.Span{}
+
+		return term
+	case BigIntTerm:
+		term.Span = token.Span{}
+
+		return term
+	case AttributeTerm:
+		term.Span = token.Span{}
+
+		return term
+	case GroupTerm:
+		members := make([]Term, 0, len(term.Members))
+
+		for _, member := range term.Members {
+			members = append(members, TermWithoutSpans(member))
+		}
+
+		term.Members, term.Span = members, token.Span{}
+
+		return term
+	case KeepTerm:
+		term.Pool, term.Span = poolWithoutSpans(term.Pool), token.Span{}
+
+		return term
+	case SuccessTerm:
+		term.Pool, term.Span = poolWithoutSpans(term.Pool), token.Span{}
+
+		return term
+	case CriticalTerm:
+		term.Pool, term.Span = poolWithoutSpans(term.Pool), token.Span{}
+
+		return term
+	default:
+		return term
+	}
+}
+
+func poolWithoutSpans(pool Pool) Pool {
+	//nolint:forcetypeassert
+	return TermWithoutSpans(pool).(Pool)
+}
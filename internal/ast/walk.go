@@ -0,0 +1,157 @@
+package ast
+
+import "slices"
+
+// Visitor's Visit method is called for each term found by Walk. When the
+// visitor it returns is not nil, Walk visits each child of the term with it and
+// then calls its Visit method with nil.
+type Visitor interface {
+	Visit(term Term) Visitor
+}
+
+// Walk traverses term depth-first, visiting children in the order they are
+// evaluated.
+func Walk(visitor Visitor, term Term) {
+	if visitor = visitor.Visit(term); visitor == nil {
+		return
+	}
+
+	for _, child := range Children(term) {
+		Walk(visitor, child)
+	}
+
+	visitor.Visit(nil)
+}
+
+type inspector func(Term) bool
+
+func (inspector inspector) Visit(term Term) Visitor {
+	if inspector(term) {
+		return inspector
+	}
+
+	return nil
+}
+
+// Inspect calls inspect for term and each of its children depth-first, and
+// calls it with nil after the children of a term. The children of a term are
+// skipped when inspect returns false for it.
+func Inspect(term Term, inspect func(Term) bool) {
+	Walk(inspector(inspect), term)
+}
+
+// Children returns the terms directly inside term in the order they are
+// evaluated.
+func Children(term Term) []Term {
+	switch term := term.(type) {
+	case CompareTerm:
+		return []Term{term.Left, term.Right}
+	case ConditionalTerm:
+		return []Term{term.Condition, term.Then, term.Else}
+	case MultiplyTerm:
+		return []Term{term.Left, term.Right}
+	case DivideTerm:
+		return []Term{term.Left, term.Right}
+	case AddTerm:
+		return []Term{term.Left, term.Right}
+	case SubtractTerm:
+		return []Term{term.Left, term.Right}
+	case DynamicDiceTerm:
+		return []Term{term.Count, term.Faces}
+	case LabelTerm:
+		return []Term{term.Term}
+	case GroupTerm:
+		return term.Members
+	case KeepTerm:
+		return []Term{term.Pool}
+	case SuccessTerm:
+		return []Term{term.Pool}
+	case CriticalTerm:
+		return []Term{term.Pool}
+	default:
+		// DiceTerm, CustomDiceTerm, IntTerm, BigIntTerm and AttributeTerm
+		// have no children.
+		return nil
+	}
+}
+
+// WithChildren returns a copy of term with the children returned by Children
+// replaced, in the same order. Pools may only be replaced by pools.
+//
+//nolint:forcetypeassert
+func WithChildren(term Term, children []Term) Term {
+	switch term := term.(type) {
+	case CompareTerm:
+		term.Left, term.Right = children[0], children[1]
+
+		return term
+	case ConditionalTerm:
+		term.Condition, term.Then, term.Else = children[0], children[1], children[2]
+
+		return term
+	case MultiplyTerm:
+		term.Left, term.Right = children[0], children[1]
+
+		return term
+	case DivideTerm:
+		term.Left, term.Right = children[0], children[1]
+
+		return term
+	case AddTerm:
+		term.Left, term.Right = children[0], children[1]
+
+		return term
+	case SubtractTerm:
+		term.Left, term.Right = children[0], children[1]
+
+		return term
+	case DynamicDiceTerm:
+		term.Count, term.Faces = children[0], children[1]
+
+		return term
+	case LabelTerm:
+		term.Term = children[0]
+
+		return term
+	case GroupTerm:
+		term.Members = children
+
+		return term
+	case KeepTerm:
+		term.Pool = children[0].(Pool)
+
+		return term
+	case SuccessTerm:
+		term.Pool = children[0].(Pool)
+
+		return term
+	case CriticalTerm:
+		term.Pool = children[0].(Pool)
+
+		return term
+	default:
+		return term
+	}
+}
+
+// ReplaceFirst returns a copy of term with the first term in the order Walk
+// visits them for which replace reports true swapped for the term it returns,
+// and reports whether there was one.
+func ReplaceFirst(term Term, replace func(Term) (Term, bool)) (Term, bool) {
+	if replacement, isReplaced := replace(term); isReplaced {
+		return replacement, true
+	}
+
+	children := Children(term)
+
+	for index, child := range children {
+		if replacement, isReplaced := ReplaceFirst(child, replace); isReplaced {
+			children = slices.Clone(children)
+			children[index] = replacement
+
+			return WithChildren(term, children), true
+		}
+	}
+
+	return term, false
+}
@@ -0,0 +1,356 @@
+// Package english translates formulas written in English, such as "roll two d
+// six plus three", into the notation the parser reads, such as "2d6 + 3".
+package english
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Words for numbers below a hundred that need no other words.
+var numbers = map[string]int{
+	"zero": 0, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6, "seven": 7, "eight": 8, "nine": 9,
+	"ten": 10, "eleven": 11, "twelve": 12, "thirteen": 13, "fourteen": 14, "fifteen": 15, "sixteen": 16,
+	"seventeen": 17, "eighteen": 18, "nineteen": 19, "twenty": 20, "thirty": 30, "forty": 40, "fifty": 50,
+	"sixty": 60, "seventy": 70, "eighty": 80, "ninety": 90,
+}
+
+var operators = map[string]string{
+	"plus":       "+",
+	"and":        "+",
+	"minus":      "-",
+	"negative":   "-",
+	"times":      "*",
+	"multiplied": "*",
+	"divided":    "/",
+	"over":       "/",
+}
+
+// Words that carry no meaning in a formula, as in "roll me the highest".
+var fillers = map[string]bool{
+	"roll": true, "rolls": true, "rolling": true, "please": true, "me": true, "by": true, "the": true,
+	"a": true, "an": true,
+}
+
+type translator struct {
+	words []string
+	index int
+	// Pieces of notation, which are joined with spaces.
+	pieces []string
+	// The index of the piece holding the last dice rolled, or -1.
+	lastDice int
+	// Set once a word of English has been translated.
+	translated bool
+}
+
+// Translate rewrites the English words of input in dice notation and reports
+// whether there were any. Words it does not know are kept as they are, so
+// English can be mixed with notation, as in "2d6 plus three".
+func Translate(input string) (string, bool) {
+	translator := translator{words: split(input), index: 0, pieces: nil, lastDice: -1, translated: false}
+
+	for translator.index < len(translator.words) {
+		translator.translateNext()
+	}
+
+	return join(translator.pieces), translator.translated
+}
+
+func (translator *translator) word(index int) string {
+	if index >= len(translator.words) {
+		return ""
+	}
+
+	return strings.ToLower(translator.words[index])
+}
+
+func (translator *translator) translateNext() {
+	word := translator.word(translator.index)
+
+	count, next, isNumber := translator.readNumber(translator.index)
+	if faces, next, isDice := translator.readDie(next); isNumber && isDice {
+		translator.addDice(strconv.Itoa(count)+"d"+strconv.Itoa(faces), next)
+
+		return
+	}
+
+	// The number may be the faces, as in "a twenty sided die".
+	if faces, next, isDice := translator.readDie(translator.index); isDice {
+		translator.addDice("1d"+strconv.Itoa(faces), next)
+
+		return
+	}
+
+	// "A" and "an" alone only stand for one before a die.
+	if isNumber && (count != 1 || (word != "a" && word != "an")) {
+		translator.translated = translator.translated || !isDigits(word)
+		translator.pieces = append(translator.pieces, strconv.Itoa(count))
+		translator.index = next
+
+		return
+	}
+
+	if translator.readAdvantage() || translator.readSelection() {
+		return
+	}
+
+	translator.index++
+
+	if operator, isOperator := operators[word]; isOperator {
+		translator.translated = true
+		translator.pieces = append(translator.pieces, operator)
+
+		return
+	}
+
+	if fillers[word] {
+		translator.translated = true
+
+		return
+	}
+
+	// Notation such as "1d20" can still be rolled with advantage.
+	if isDice(word) {
+		translator.lastDice = len(translator.pieces)
+	}
+
+	translator.pieces = append(translator.pieces, translator.words[translator.index-1])
+}
+
+func (translator *translator) addDice(dice string, next int) {
+	translator.translated = true
+	translator.lastDice = len(translator.pieces)
+	translator.pieces = append(translator.pieces, dice)
+	translator.index = next
+}
+
+// Read a number starting at index, such as "two hundred and five" or "12", and
+// return it with the index of the word after it.
+func (translator *translator) readNumber(index int) (int, int, bool) {
+	word := translator.word(index)
+
+	if isDigits(word) {
+		value, err := strconv.Atoi(word)
+
+		return value, index + 1, err == nil
+	}
+
+	if word == "a" || word == "an" {
+		if translator.word(index+1) != "hundred" {
+			return 1, index + 1, true
+		}
+
+		word = "one"
+	}
+
+	value, isNumber := numbers[word]
+	if !isNumber {
+		return 0, index, false
+	}
+
+	if index++; value == 0 {
+		return 0, index, true
+	}
+
+	for ; ; index++ {
+		next, isNumber := numbers[translator.word(index)]
+
+		switch {
+		// "Twenty one", but not "ten one" or "twenty thirty".
+		case isNumber && next > 0 && next < 10 && value%10 == 0 && value%100 != 10:
+			value += next
+		// "One hundred twenty", but not "twenty twenty".
+		case isNumber && next >= 10 && value%100 == 0:
+			value += next
+		case translator.word(index) == "hundred" && value < 100 && value%100 != 0:
+			value *= 100
+		// Allow "one hundred and five" without reading "and" as plus.
+		case translator.word(index) == "and" && value%100 == 0 && value >= 100 && numbers[translator.word(index+1)] > 0:
+		default:
+			return value, index, true
+		}
+	}
+}
+
+// Read a die starting at index, such as "d six", "d20" or "six sided die", and
+// return its faces with the index of the word after it.
+func (translator *translator) readDie(index int) (int, int, bool) {
+	word := translator.word(index)
+
+	if strings.HasPrefix(word, "d") && isDigits(word[1:]) {
+		faces, err := strconv.Atoi(word[1:])
+
+		return faces, index + 1, err == nil
+	}
+
+	if word == "d" || word == "dee" {
+		if faces, next, isNumber := translator.readNumber(index + 1); isNumber {
+			return faces, next, true
+		}
+
+		return 0, index, false
+	}
+
+	faces, next, isNumber := translator.readNumber(index)
+	if !isNumber || translator.word(next) != "sided" {
+		return 0, index, false
+	}
+
+	next++
+
+	if word := translator.word(next); word == "die" || word == "dice" {
+		next++
+	}
+
+	return faces, next, true
+}
+
+// Read "with advantage" or "with disadvantage", which keep the better or worse
+// of two rolls of the last dice.
+func (translator *translator) readAdvantage() bool {
+	next := translator.index
+	if word := translator.word(next); word == "with" || word == "at" {
+		next++
+	}
+
+	selection := map[string]string{"advantage": "kh1", "disadvantage": "kl1"}[translator.word(next)]
+	if selection == "" || translator.lastDice < 0 {
+		return false
+	}
+
+	dice := translator.pieces[translator.lastDice]
+	if strings.HasPrefix(dice, "1d") && isDigits(dice[2:]) {
+		translator.pieces[translator.lastDice] = "2" + dice[1:] + selection
+	} else {
+		translator.pieces[translator.lastDice] = "{" + dice + ", " + dice + "}" + selection
+	}
+
+	translator.translated = true
+	translator.index = next + 1
+
+	return true
+}
+
+// Read "keep the highest three" or "drop lowest", which select from the dice
+// just rolled.
+func (translator *translator) readSelection() bool {
+	if translator.lastDice < 0 || translator.lastDice != len(translator.pieces)-1 {
+		return false
+	}
+
+	next := translator.index
+	action := translator.word(next)
+
+	if action != "keep" && action != "drop" {
+		return false
+	}
+
+	if next++; translator.word(next) == "the" {
+		next++
+	}
+
+	end := map[string]string{"highest": "h", "lowest": "l"}[translator.word(next)]
+	if end == "" {
+		return false
+	}
+
+	count, next, isNumber := translator.readNumber(next + 1)
+	if !isNumber {
+		count = 1
+	}
+
+	translator.pieces[translator.lastDice] += action[:1] + end + strconv.Itoa(count)
+	translator.translated = true
+	translator.index = next
+
+	return true
+}
+
+func isDigits(word string) bool {
+	if word == "" {
+		return false
+	}
+
+	for _, currentRune := range word {
+		if currentRune < '0' || currentRune > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isLetters(word string) bool {
+	return word != "" && strings.IndexFunc(word, func(currentRune rune) bool { return !unicode.IsLetter(currentRune) }) < 0
+}
+
+// Report whether word is dice notation such as "2d6" or "d20".
+func isDice(word string) bool {
+	count, faces, isCut := strings.Cut(word, "d")
+
+	return isCut && (count == "" || isDigits(count)) && isDigits(faces)
+}
+
+// Split input into words, with brackets and commas as words of their own so
+// that "(two" reads as "(" and "two".
+func split(input string) []string {
+	words := []string{}
+
+	for _, field := range strings.Fields(input) {
+		for strings.HasPrefix(field, "(") {
+			words = append(words, "(")
+			field = field[1:]
+		}
+
+		end := len(field)
+		for end > 0 && strings.ContainsRune("),", rune(field[end-1])) {
+			end--
+		}
+
+		if end > 0 {
+			words = append(words, splitHyphens(field[:end])...)
+		}
+
+		for _, closing := range field[end:] {
+			words = append(words, string(closing))
+		}
+	}
+
+	return words
+}
+
+// Split words joined by hyphens, as in "twenty-one" and "six-sided", but keep
+// hyphens in notation such as "2d6-1".
+func splitHyphens(field string) []string {
+	parts := strings.Split(field, "-")
+	words := []string{parts[0]}
+
+	for _, part := range parts[1:] {
+		last := words[len(words)-1]
+
+		if isLetters(part) && (isLetters(last) || isDigits(last)) {
+			words = append(words, part)
+		} else {
+			words[len(words)-1] += "-" + part
+		}
+	}
+
+	return words
+}
+
+// Join pieces of notation with spaces, except inside brackets and before
+// commas.
+func join(pieces []string) string {
+	var output strings.Builder
+
+	for index, piece := range pieces {
+		if index > 0 && piece != "," && piece != ")" && pieces[index-1] != "(" {
+			output.WriteByte(' ')
+		}
+
+		output.WriteString(piece)
+	}
+
+	return output.String()
+}
@@ -0,0 +1,42 @@
+package english_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"meganruggiero.com/dicebot/internal/english"
+	"meganruggiero.com/dicebot/internal/parser"
+)
+
+func TestTranslate(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"roll two d six plus three":                                                  "2d6 + 3",
+		"Two D6 plus three times two":                                                "2d6 + 3 * 2",
+		"a d twenty plus five with advantage":                                        "2d20kh1 + 5",
+		"1d20 plus 5 with disadvantage":                                              "2d20kl1 + 5",
+		"three d four at advantage":                                                  "{3d4, 3d4}kh1",
+		"four d six drop the lowest":                                                 "4d6dl1",
+		"eight six-sided dice keep the highest three":                                "8d6kh3",
+		"(one d eight plus two) divided by twenty-one":                               "(1d8 + 2) / 21",
+		"a hundred sided die minus negative seven":                                   "1d100 - - 7",
+		"attack = a d twenty plus five, damage = two d six and one hundred and five": "attack = 1d20 + 5, damage = 2d6 + 105",
+	}
+
+	for input, expected := range tests {
+		translated, isEnglish := english.Translate(input)
+		assert.True(t, isEnglish, "%q should be English", input)
+		assert.Equal(t, expected, translated, "%q should translate to %q", input, expected)
+
+		_, err := parser.Parse(translated)
+		assert.NoError(t, err, "%q should parse", translated)
+	}
+
+	// Notation is left alone.
+	for _, input := range []string{"1d20 + 5", "2d6-1", "{1d20, 1d20}kh1 >= 15", "fire = 8d6 [fire]"} {
+		translated, isEnglish := english.Translate(input)
+		assert.False(t, isEnglish, "%q should not be English", input)
+		assert.Equal(t, input, translated)
+	}
+}
@@ -1,7 +1,6 @@
 package lexer
 
 import (
-	"regexp"
 	"unicode"
 	"unicode/utf8"
 
@@ -10,8 +9,40 @@ import (
 
 const eof = rune(-1)
 
-// Matches "d", case-insensitive, with digits after it.
-var regexpD = regexp.MustCompile(`\A[Dd]\d+\z`)
+// Maps runes that mobile keyboards and rulebooks use in place of ASCII to the
+// rune the lexer treats them as.
+var normalRunes = map[rune]rune{
+	'×': '*', // Multiplication Sign
+	'·': '*', // Middle Dot
+	'⋅': '*', // Dot Operator
+	'÷': '/', // Division Sign
+	'∕': '/', // Division Slash
+	'−': '-', // Minus Sign
+	'–': '-', // En Dash
+	// Full-width forms.
+	'＋': '+',
+	'－': '-',
+	'＊': '*',
+	'／': '/',
+	'＝': '=',
+	'＜': '<',
+	'＞': '>',
+	'（': '(',
+	'）': ')',
+	'，': ',',
+	'０': '0',
+	'１': '1',
+	'２': '2',
+	'３': '3',
+	'４': '4',
+	'５': '5',
+	'６': '6',
+	'７': '7',
+	'８': '8',
+	'９': '9',
+	'Ｄ': 'D',
+	'ｄ': 'd',
+}
 
 type Lexer struct {
 	input           string
@@ -37,12 +68,46 @@ func New(input string) *Lexer {
 	return &lexer
 }
 
-//nolint:cyclop,funlen,wsl
-func (lexer *Lexer) Read() token.Token {
-	// Eat whitespace and do not include it in the token.
-	for lexer.currentRune == ',' || unicode.IsSpace(lexer.currentRune) {
+// NewRange returns a lexer that reads input from the byte offset start up to
+// end, with positions counted from the start of input.
+func NewRange(input string, start, end int) *Lexer {
+	lexer := New(input[:end])
+	lexer.Seek(start)
+
+	return lexer
+}
+
+// Seek moves the lexer forward to the byte offset, unless it is already past
+// it.
+func (lexer *Lexer) Seek(offset int) {
+	for lexer.offset < offset && lexer.currentRune != eof {
 		lexer.readRune()
 	}
+}
+
+// Until returns a lexer that reads on from the position of lexer up to the
+// byte offset end, which must be a rune boundary at or after that position.
+// Unlike NewRange, the input before it is not read again.
+func (lexer *Lexer) Until(end int) *Lexer {
+	until := *lexer
+	until.input = lexer.input[:end]
+
+	// The current rune is past the end when the lexer is already there.
+	if until.offset >= end {
+		until.currentRuneSize, until.currentRune = 0, eof
+	}
+
+	return &until
+}
+
+// Position returns the position of the next rune to be read.
+func (lexer *Lexer) Position() token.Position {
+	return token.Position{Offset: lexer.offset, Line: lexer.line, Column: lexer.column}
+}
+
+//nolint:cyclop,funlen,gocognit,wsl
+func (lexer *Lexer) Read() token.Token {
+	lexer.skipWhitespaceAndComments()
 
 	kind := token.Unrecognized
 	start := lexer.offset
@@ -55,15 +120,96 @@ func (lexer *Lexer) Read() token.Token {
 		lexer.readRune()
 	case eof:
 		kind = token.EOF
+	case ',':
+		kind = token.Comma
+		lexer.readRune()
 	case '=':
 		kind = token.Equal
 		lexer.readRune()
+
+		if lexer.currentRune == '=' {
+			kind = token.EqualEqual
+			lexer.readRune()
+		}
+	case '!':
+		// Keep kind set to token.Unrecognized unless this is "!=".
+		lexer.readRune()
+
+		if lexer.currentRune == '=' {
+			kind = token.NotEqual
+			lexer.readRune()
+		}
+	case '≠':
+		kind = token.NotEqual
+		lexer.readRune()
+	case '≤':
+		kind = token.LessEqual
+		lexer.readRune()
+	case '≥':
+		kind = token.GreaterEqual
+		lexer.readRune()
+	case '<':
+		kind = token.Less
+		lexer.readRune()
+
+		if lexer.currentRune == '=' {
+			kind = token.LessEqual
+			lexer.readRune()
+		}
+	case '>':
+		kind = token.Greater
+		lexer.readRune()
+
+		if lexer.currentRune == '=' {
+			kind = token.GreaterEqual
+			lexer.readRune()
+		}
 	case '(':
 		kind = token.LeftParentheses
 		lexer.readRune()
 	case ')':
 		kind = token.RightParentheses
 		lexer.readRune()
+	case '{':
+		kind = token.LeftBrace
+		lexer.readRune()
+	case '}':
+		kind = token.RightBrace
+		lexer.readRune()
+	case ':':
+		kind = token.Colon
+		lexer.readRune()
+	case '"':
+		// Keep kind set to token.Unrecognized unless the string is
+		// closed before the end of the line.
+		lexer.readRune()
+
+		for lexer.currentRune != '"' && lexer.currentRune != eof && !token.IsLineSeparator(lexer.currentRune) {
+			if lexer.currentRune == '\\' {
+				lexer.readRune()
+
+				if lexer.currentRune == eof || token.IsLineSeparator(lexer.currentRune) {
+					break
+				}
+			}
+
+			lexer.readRune()
+		}
+
+		if lexer.currentRune == '"' {
+			kind = token.String
+			lexer.readRune()
+		}
+	case '[':
+		// Keep kind set to token.Unrecognized unless the label is closed.
+		for lexer.currentRune != ']' && lexer.currentRune != eof {
+			lexer.readRune()
+		}
+
+		if lexer.currentRune == ']' {
+			kind = token.Label
+			lexer.readRune()
+		}
 	case '^':
 		kind = token.Exponentiate
 		lexer.readRune()
@@ -84,50 +230,77 @@ func (lexer *Lexer) Read() token.Token {
 		for '0' <= lexer.currentRune && lexer.currentRune <= '9' {
 			lexer.readRune()
 		}
+	case 'D', 'd':
+		kind = token.Word
+		lexer.readRune()
+
+		// A "d" is a dice term when followed by digits, a list of faces
+		// or a parenthesised number of faces. The digits end the dice
+		// term so that modifiers such as "kh1" may follow.
+		switch {
+		case '0' <= lexer.currentRune && lexer.currentRune <= '9':
+			kind = token.D
+			for '0' <= lexer.currentRune && lexer.currentRune <= '9' {
+				lexer.readRune()
+			}
+		case lexer.currentRune == '{' || lexer.currentRune == '(':
+			kind = token.D
+		default:
+			lexer.readWord()
+		}
 	default:
 		if lexer.currentRune == '_' || unicode.IsLetter(lexer.currentRune) {
 			kind = token.Word
-			for lexer.currentRune == '_' || unicode.IsLetter(lexer.currentRune) || unicode.IsNumber(lexer.currentRune) {
-				lexer.readRune()
-			}
+			lexer.readWord()
 		} else {
 			// Keep kind set to token.Unrecognized.
 			lexer.readRune()
 		}
 	}
 
-	str := lexer.input[start:lexer.offset]
+	return token.New(start, line, column, kind, lexer.input[start:lexer.offset])
+}
 
-	if regexpD.MatchString(str) {
-		kind = token.D
+func (lexer *Lexer) readWord() {
+	for lexer.currentRune == '_' || unicode.IsLetter(lexer.currentRune) || unicode.IsNumber(lexer.currentRune) {
+		lexer.readRune()
 	}
+}
 
-	return token.New(line, column, kind, str)
+// Eat whitespace and comments, which run from "#" to the end of the line, and
+// do not include them in the token.
+func (lexer *Lexer) skipWhitespaceAndComments() {
+	for {
+		switch {
+		case unicode.IsSpace(lexer.currentRune):
+			lexer.readRune()
+		case lexer.currentRune == '#':
+			for lexer.currentRune != eof && !token.IsLineSeparator(lexer.currentRune) {
+				lexer.readRune()
+			}
+		default:
+			return
+		}
+	}
 }
 
 func (lexer *Lexer) readRune() {
-	const (
-		FileSeparator           = rune(0x1C)
-		GroupSeparator          = rune(0x1D)
-		InformationSeparatorTwo = rune(0x1E)
-		NextLine                = rune(0x85)
-		LineSeparator           = rune(0x2028)
-		ParagraphSeparator      = rune(0x2029)
-	)
-
 	lexer.offset += lexer.currentRuneSize
 	nextRune, nextRuneSize := utf8.DecodeRuneInString(lexer.input[lexer.offset:])
 
-	if nextRuneSize == 0 {
+	// Tokens keep the original text so that errors quote what was typed.
+	if normalRune, ok := normalRunes[nextRune]; ok {
+		nextRune = normalRune
+	}
+
+	switch {
+	case nextRuneSize == 0:
 		nextRune = eof // Easier for switch statements.
-	} else {
-		switch nextRune {
-		case '\n', '\r', FileSeparator, GroupSeparator, InformationSeparatorTwo, NextLine, LineSeparator, ParagraphSeparator:
-			lexer.line++
-			lexer.column = 0
-		default:
-			lexer.column++
-		}
+	case token.IsLineSeparator(nextRune):
+		lexer.line++
+		lexer.column = 0
+	default:
+		lexer.column++
 	}
 
 	lexer.currentRuneSize = nextRuneSize
@@ -14,21 +14,199 @@ func TestLexer(t *testing.T) {
 	lexer := lexer.New("2d4 + d20 - 4 D8?,\nkeyword = Dice_1234")
 
 	expectations := []token.Token{
-		token.New(1, 1, token.Int, "2"),
-		token.New(1, 2, token.D, "d4"),
-		token.New(1, 5, token.Add, "+"),
-		token.New(1, 7, token.D, "d20"),
-		token.New(1, 11, token.Subtract, "-"),
-		token.New(1, 13, token.Int, "4"),
-		token.New(1, 15, token.D, "D8"),
-		token.New(1, 17, token.Unrecognized, "?"),
-		token.New(2, 1, token.Word, "keyword"),
-		token.New(2, 9, token.Equal, "="),
-		token.New(2, 11, token.Word, "Dice_1234"),
-		token.New(2, 19, token.EOF, ""),
+		token.New(0, 1, 1, token.Int, "2"),
+		token.New(1, 1, 2, token.D, "d4"),
+		token.New(4, 1, 5, token.Add, "+"),
+		token.New(6, 1, 7, token.D, "d20"),
+		token.New(10, 1, 11, token.Subtract, "-"),
+		token.New(12, 1, 13, token.Int, "4"),
+		token.New(14, 1, 15, token.D, "D8"),
+		token.New(16, 1, 17, token.Unrecognized, "?"),
+		token.New(17, 1, 18, token.Comma, ","),
+		token.New(19, 2, 1, token.Word, "keyword"),
+		token.New(27, 2, 9, token.Equal, "="),
+		token.New(29, 2, 11, token.Word, "Dice_1234"),
+		token.New(38, 2, 19, token.EOF, ""),
 	}
 
 	for index, expectation := range expectations {
 		assert.Equal(t, expectation, lexer.Read(), "token %v should match expectation", index)
 	}
 }
+
+func TestLexerComparisons(t *testing.T) {
+	t.Parallel()
+
+	lexer := lexer.New("= == != ! < <= > >=")
+
+	expectations := []token.Token{
+		token.New(0, 1, 1, token.Equal, "="),
+		token.New(2, 1, 3, token.EqualEqual, "=="),
+		token.New(5, 1, 6, token.NotEqual, "!="),
+		token.New(8, 1, 9, token.Unrecognized, "!"),
+		token.New(10, 1, 11, token.Less, "<"),
+		token.New(12, 1, 13, token.LessEqual, "<="),
+		token.New(15, 1, 16, token.Greater, ">"),
+		token.New(17, 1, 18, token.GreaterEqual, ">="),
+		token.New(19, 1, 19, token.EOF, ""),
+	}
+
+	for index, expectation := range expectations {
+		assert.Equal(t, expectation, lexer.Read(), "token %v should match expectation", index)
+	}
+}
+
+func TestLexerDice(t *testing.T) {
+	t.Parallel()
+
+	lexer := lexer.New("d{1:2} d { d20kh1 dice")
+
+	expectations := []token.Token{
+		token.New(0, 1, 1, token.D, "d"),
+		token.New(1, 1, 2, token.LeftBrace, "{"),
+		token.New(2, 1, 3, token.Int, "1"),
+		token.New(3, 1, 4, token.Colon, ":"),
+		token.New(4, 1, 5, token.Int, "2"),
+		token.New(5, 1, 6, token.RightBrace, "}"),
+		token.New(7, 1, 8, token.Word, "d"),
+		token.New(9, 1, 10, token.LeftBrace, "{"),
+		token.New(11, 1, 12, token.D, "d20"),
+		token.New(14, 1, 15, token.Word, "kh1"),
+		token.New(18, 1, 19, token.Word, "dice"),
+		token.New(22, 1, 22, token.EOF, ""),
+	}
+
+	for index, expectation := range expectations {
+		assert.Equal(t, expectation, lexer.Read(), "token %v should match expectation", index)
+	}
+}
+
+func TestLexerLabels(t *testing.T) {
+	t.Parallel()
+
+	lexer := lexer.New("2d6 [ slashing ] # comment [\n+ 1d8[fire] [oops")
+
+	expectations := []token.Token{
+		token.New(0, 1, 1, token.Int, "2"),
+		token.New(1, 1, 2, token.D, "d6"),
+		token.New(4, 1, 5, token.Label, "[ slashing ]"),
+		token.New(29, 2, 1, token.Add, "+"),
+		token.New(31, 2, 3, token.Int, "1"),
+		token.New(32, 2, 4, token.D, "d8"),
+		token.New(34, 2, 6, token.Label, "[fire]"),
+		token.New(41, 2, 13, token.Unrecognized, "[oops"),
+		token.New(46, 2, 17, token.EOF, ""),
+	}
+
+	for index, expectation := range expectations {
+		assert.Equal(t, expectation, lexer.Read(), "token %v should match expectation", index)
+	}
+}
+
+func TestLexerStrings(t *testing.T) {
+	t.Parallel()
+
+	lexer := lexer.New(`"Attack #2" "say \"hi\" \\" "open` + "\n" + `"`)
+
+	expectations := []token.Token{
+		token.New(0, 1, 1, token.String, `"Attack #2"`),
+		token.New(12, 1, 13, token.String, `"say \"hi\" \\"`),
+		token.New(28, 1, 29, token.Unrecognized, `"open`),
+		token.New(34, 2, 1, token.Unrecognized, `"`),
+		token.New(35, 2, 1, token.EOF, ""),
+	}
+
+	for index, expectation := range expectations {
+		assert.Equal(t, expectation, lexer.Read(), "token %v should match expectation", index)
+	}
+
+	assert.Equal(t, "Attack #2", expectations[0].Unquote())
+	assert.Equal(t, `say "hi" \`, expectations[1].Unquote())
+}
+
+func TestLexerRange(t *testing.T) {
+	t.Parallel()
+
+	lexer := lexer.NewRange("[[1d6]]\n[[2 + 3]]", 10, 15)
+
+	assert.Equal(t, token.Position{Offset: 10, Line: 2, Column: 3}, lexer.Position())
+
+	expectations := []token.Token{
+		token.New(10, 2, 3, token.Int, "2"),
+		token.New(12, 2, 5, token.Add, "+"),
+		token.New(14, 2, 7, token.Int, "3"),
+		token.New(15, 2, 7, token.EOF, ""),
+	}
+
+	for index, expectation := range expectations {
+		assert.Equal(t, expectation, lexer.Read(), "token %v should match expectation", index)
+	}
+}
+
+func TestLexerUntil(t *testing.T) {
+	t.Parallel()
+
+	input := "[[1d6]]\n[[2 + 3]]"
+	cursor := lexer.New(input)
+	cursor.Seek(10)
+
+	// Lexing a range from a lexer that has already read up to it reads the
+	// same tokens as starting over.
+	assert.Equal(t, lexer.NewRange(input, 10, 15).Position(), cursor.Position())
+	assert.Equal(t, lexer.NewRange(input, 10, 15).Read(), cursor.Until(15).Read())
+	assert.Equal(t, lexer.NewRange(input, 10, 15).Position(), cursor.Position(), "the lexer should not move")
+
+	// Seeking backwards does nothing, and a range that ends where the lexer
+	// is has no tokens.
+	cursor.Seek(3)
+	assert.Equal(t, 10, cursor.Position().Offset)
+	assert.Equal(t, token.EOF, cursor.Until(10).Read().Kind)
+}
+
+func TestLexerUnicode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input string
+		kind  token.Kind
+		value int
+	}{
+		{input: "×", kind: token.Multiply, value: 0},
+		{input: "·", kind: token.Multiply, value: 0},
+		{input: "÷", kind: token.Divide, value: 0},
+		{input: "−", kind: token.Subtract, value: 0},
+		{input: "–", kind: token.Subtract, value: 0},
+		{input: "＋", kind: token.Add, value: 0},
+		{input: "－", kind: token.Subtract, value: 0},
+		{input: "＝", kind: token.Equal, value: 0},
+		{input: "＝＝", kind: token.EqualEqual, value: 0},
+		{input: "≠", kind: token.NotEqual, value: 0},
+		{input: "≤", kind: token.LessEqual, value: 0},
+		{input: "＞=", kind: token.GreaterEqual, value: 0},
+		{input: "≥", kind: token.GreaterEqual, value: 0},
+		{input: "（", kind: token.LeftParentheses, value: 0},
+		{input: "，", kind: token.Comma, value: 0},
+		{input: "４２", kind: token.Int, value: 42},
+		{input: "4２", kind: token.Int, value: 42},
+		{input: "ｄ２０", kind: token.D, value: 20},
+		{input: "Ｄ6", kind: token.D, value: 6},
+	}
+
+	for _, test := range tests {
+		// Tokens keep the original text so errors can quote it.
+		actual := lexer.New(test.input).Read()
+		assert.Equal(t, token.New(0, 1, 1, test.kind, test.input), actual, "%q should match expectation", test.input)
+
+		value, fits := actual.Int()
+		assert.True(t, fits, "%q should fit in an int", test.input)
+		assert.Equal(t, test.value, value, "%q should have the expected value", test.input)
+	}
+
+	// Long literals are read whole rather than wrapping around.
+	actual := lexer.New("99999999999999999999").Read()
+	assert.Equal(t, token.New(0, 1, 1, token.Int, "99999999999999999999"), actual)
+	assert.Equal(t, "99999999999999999999", actual.BigInt().String())
+
+	_, fits := actual.Int()
+	assert.False(t, fits)
+}
@@ -0,0 +1,71 @@
+package parser
+
+import (
+	"strings"
+
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+// An advantage is a keyword that rolls the following d20 more than once and
+// keeps one of the rolls.
+type advantage struct {
+	// Words are the words of the keyword, in lower case.
+	words     []string
+	count     int
+	selection ast.Selection
+}
+
+var advantages = []advantage{
+	{words: []string{"adv"}, count: 2, selection: ast.KeepHighest},
+	{words: []string{"dis"}, count: 2, selection: ast.KeepLowest},
+	{words: []string{"elven", "accuracy"}, count: 3, selection: ast.KeepHighest}, //nolint:gomnd
+}
+
+// Return the advantage keyword at the current token, if any, and whether there
+// is one.
+func (parser *parser) atAdvantage() (advantage, bool) {
+	for _, advantage := range advantages {
+		matches := true
+
+		for index, word := range advantage.words {
+			current := parser.peek(index)
+			if current.Kind != token.Word || !strings.EqualFold(current.String, word) {
+				matches = false
+
+				break
+			}
+		}
+
+		if matches {
+			return advantage, true
+		}
+	}
+
+	return advantage{words: nil, count: 0, selection: ast.KeepHighest}, false
+}
+
+// Parse an advantage keyword and the bottom term after it, such as "adv d20" or
+// "elven accuracy (1d20 + 5)", rolling the first d20 of the term with
+// advantage.
+func (parser *parser) parseAdvantage() (ast.Term, *SyntaxError) {
+	advantage, _ := parser.atAdvantage()
+
+	for range advantage.words {
+		parser.readToken()
+	}
+
+	first := parser.currentToken
+
+	term, err := parser.parseBottomTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	term, rollsD20 := ast.KeepD20(term, advantage.count, advantage.selection)
+	if !rollsD20 {
+		return nil, &SyntaxError{Expected: []string{"d20"}, Received: first, Suggestion: ""}
+	}
+
+	return term, nil
+}
@@ -0,0 +1,519 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/lexer"
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+// Dialect is the dice syntax of another tool, so that macros can be pasted
+// from it unchanged.
+type Dialect int
+
+const (
+	// Native is the syntax described in GRAMMAR.md.
+	Native Dialect = iota
+	// Roll20 reads commands such as "/r 4d6d1" and inline rolls such as
+	// "[[1d20+5]]", including those in roll templates. Comparisons after
+	// dice count successes and include the target, so 3d6>4 counts the dice
+	// that rolled 4 or more.
+	Roll20
+	// Foundry reads commands such as "/r 2d20kh" and inline rolls. The cs
+	// and cf modifiers count successes and failures rather than marking
+	// critical dice.
+	Foundry
+	// Avrae reads commands such as "!r 1d20+5 adv Stealth" as a single roll
+	// named by the comment after it. Groups are written in parentheses, and
+	// ph and pl drop dice.
+	Avrae
+)
+
+var dialectNames = map[Dialect]string{
+	Native:  "native",
+	Roll20:  "roll20",
+	Foundry: "foundry",
+	Avrae:   "avrae",
+}
+
+func (dialect Dialect) String() string {
+	if name, isNamed := dialectNames[dialect]; isNamed {
+		return name
+	}
+
+	return fmt.Sprintf("Dialect(%d)", int(dialect))
+}
+
+// DialectNamed returns the dialect with the given name, ignoring case, and
+// whether there is one.
+func DialectNamed(name string) (Dialect, bool) {
+	for dialect, dialectName := range dialectNames {
+		if strings.EqualFold(name, dialectName) {
+			return dialect, true
+		}
+	}
+
+	return Native, false
+}
+
+// The commands each dialect rolls with, which are skipped.
+var dialectCommands = map[Dialect][]string{
+	Native:  nil,
+	Roll20:  {"/r", "/roll", "/gr", "/gmroll"},
+	Foundry: {"/r", "/roll", "/gmr", "/gmroll", "/br", "/blindroll", "/sr", "/selfroll", "/pr", "/publicroll"},
+	Avrae:   {"!r", "!roll"},
+}
+
+// Matches the keep/drop and critical modifiers of each dialect. Roll20 and
+// Foundry also drop the lowest dice with "d", as in 4d6d1.
+var dialectModifiers = map[Dialect]*regexp.Regexp{
+	Native:  regexpModifiers,
+	Roll20:  regexpModifiers,
+	Foundry: regexp.MustCompile(`(?i)\A(?:(?:kh|kl|dh|dl|k)\d*)+\z`),
+	Avrae:   regexp.MustCompile(`(?i)\A(?:(?:kh|kl|ph|pl)\d*)+\z`),
+}
+
+// Matches a reference to a character sheet, such as @{strength},
+// @{Bob|strength} or @abilities.str.mod.
+var regexpAttribute = regexp.MustCompile(`\A@(?:\{[^{}]*\}|[\pL_][\pL\pN_]*(?:\.[\pL\pN_]+)*)`)
+
+// ParseDialect is like ParseContext, but reads input in the syntax of dialect.
+// Positions in the formula and its errors refer to input as it was typed.
+func ParseDialect(ctx context.Context, input string, dialect Dialect) (*ast.Formula, error) {
+	dialectLexer := dialectLexer{ctx: ctx, dialect: dialect, input: input, tokens: []token.Token{}, cursor: lexer.New(input)}
+	if err := dialectLexer.lexFormula(); err != nil {
+		return &ast.Formula{Equations: []ast.Equation{}}, fmt.Errorf("parsing formula: %w", err)
+	}
+
+	parser := parser{
+		input:        input,
+		dialect:      dialect,
+		tokens:       dialectLexer.tokens,
+		position:     0,
+		currentToken: token.New(0, 0, 0, token.Unrecognized, ""),
+		nextToken:    token.New(0, 0, 0, token.Unrecognized, ""),
+	}
+
+	parser.seek(0)
+
+	var (
+		formula      *ast.Formula
+		syntaxErrors SyntaxErrors
+	)
+
+	if dialect == Avrae {
+		formula, syntaxErrors = parser.parseComment()
+	} else {
+		formula, syntaxErrors = parser.parseFormula(ctx)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return formula, fmt.Errorf("parsing formula: %w", err)
+	}
+
+	if len(syntaxErrors) > 0 {
+		return formula, syntaxErrors
+	}
+
+	return formula, nil
+}
+
+// dialectLexer reads the parts of the input that are formulas into native
+// tokens, with queries replaced by their defaults.
+type dialectLexer struct {
+	ctx     context.Context //nolint:containedctx
+	dialect Dialect
+	input   string
+	tokens  []token.Token
+	// cursor reads the whole input to find positions, so that lexing each
+	// range does not read the input again from its start.
+	cursor *lexer.Lexer
+}
+
+func (dialectLexer *dialectLexer) lexFormula() error {
+	input := dialectLexer.input
+
+	// Text around inline rolls is ignored, so each inline roll is an
+	// equation.
+	if dialectLexer.dialect == Native {
+		if err := dialectLexer.lexPlain(0, len(input)); err != nil {
+			return err
+		}
+	} else if (dialectLexer.dialect == Roll20 || dialectLexer.dialect == Foundry) && strings.Contains(input, "[[") {
+		if err := dialectLexer.lexInlineRolls(); err != nil {
+			return err
+		}
+	} else if err := dialectLexer.lexRange(dialectLexer.skipCommand(0), len(input)); err != nil {
+		return err
+	}
+
+	dialectLexer.tokens = append(dialectLexer.tokens, dialectLexer.seek(len(input)).Read())
+
+	return nil
+}
+
+// Return the offset after the command that starts the text at start, if any.
+func (dialectLexer *dialectLexer) skipCommand(start int) int {
+	text := dialectLexer.input[start:]
+	trimmed := strings.TrimLeft(text, " \t\r\n")
+
+	for _, command := range dialectCommands[dialectLexer.dialect] {
+		if rest, isCut := strings.CutPrefix(trimmed, command); isCut && (rest == "" || strings.ContainsAny(rest[:1], " \t\r\n")) {
+			return start + len(text) - len(rest)
+		}
+	}
+
+	return start
+}
+
+// Lex each inline roll of the input, such as [[1d20+5]], as an equation, named
+// after the roll template property it is in, as in {{attack=[[1d20+5]]}}.
+func (dialectLexer *dialectLexer) lexInlineRolls() error {
+	input := dialectLexer.input
+	end := 0
+
+	for {
+		start := strings.Index(input[end:], "[[")
+		if start < 0 {
+			return nil
+		}
+
+		start += end
+
+		contentEnd, closing := inlineRollEnd(input, start)
+
+		// Only the first inline roll in a property is named by it.
+		property := strings.LastIndex(input[end:start], "{{")
+		if property >= 0 && !strings.Contains(input[end+property:start], "}}") {
+			property += end
+			key, _, isCut := strings.Cut(input[property+2:start], "=")
+
+			if key = strings.TrimSpace(key); isCut && key != "" {
+				dialectLexer.tokens = append(dialectLexer.tokens,
+					dialectLexer.token(property+2, token.String, quote(key)),
+					dialectLexer.token(property+2+strings.Index(input[property+2:], "="), token.Equal, "="))
+			}
+		}
+
+		if err := dialectLexer.lexRange(dialectLexer.skipCommand(start+2), contentEnd); err != nil {
+			return err
+		}
+
+		dialectLexer.tokens = append(dialectLexer.tokens, dialectLexer.token(contentEnd, token.Comma, ","))
+		end = closing
+	}
+}
+
+// Return the offsets of the "]]" that closes the inline roll starting at start
+// and of the end of it, or the end of input twice if it is not closed.
+func inlineRollEnd(input string, start int) (int, int) {
+	depth := 0
+
+	for offset := start; offset < len(input)-1; offset++ {
+		switch {
+		case input[offset:offset+2] == "[[":
+			depth++
+			offset++
+		case input[offset:offset+2] == "]]":
+			if depth--; depth == 0 {
+				return offset, offset + 2
+			}
+
+			offset++
+		case input[offset] == '[':
+			// Skip labels, as in [[8d6[fire]]].
+			if closing := strings.IndexByte(input[offset:], ']'); closing > 0 {
+				offset += closing
+			}
+		}
+	}
+
+	return len(input), len(input)
+}
+
+// Lex the input from start to end, with nested inline rolls in parentheses,
+// queries replaced by their defaults and attributes as single tokens.
+func (dialectLexer *dialectLexer) lexRange(start, end int) error {
+	input := dialectLexer.input
+
+	for start < end {
+		special := start + strings.IndexAny(input[start:end], "[?@#\"")
+		if special < start {
+			special = end
+		}
+
+		if err := dialectLexer.lexPlain(start, special); err != nil {
+			return err
+		}
+
+		if special == end {
+			return nil
+		}
+
+		next, err := dialectLexer.lexSpecial(special, end)
+		if err != nil {
+			return err
+		}
+
+		start = next
+	}
+
+	return nil
+}
+
+// Lex the construct at start that is not native syntax, if any, and return the
+// offset after it.
+func (dialectLexer *dialectLexer) lexSpecial(start, end int) (int, error) {
+	input := dialectLexer.input
+	text := input[start:end]
+
+	switch {
+	case strings.HasPrefix(text, "[["):
+		contentEnd, closing := inlineRollEnd(input, start)
+		contentEnd, closing = min(contentEnd, end), min(closing, end)
+
+		dialectLexer.tokens = append(dialectLexer.tokens, dialectLexer.token(start, token.LeftParentheses, "("))
+
+		if err := dialectLexer.lexRange(dialectLexer.skipCommand(start+2), contentEnd); err != nil {
+			return 0, err
+		}
+
+		dialectLexer.tokens = append(dialectLexer.tokens, dialectLexer.token(contentEnd, token.RightParentheses, ")"))
+
+		return closing, nil
+	case strings.HasPrefix(text, "?{") && dialectLexer.dialect == Roll20:
+		return dialectLexer.lexQuery(start, end)
+	case regexpAttribute.MatchString(text):
+		attribute := regexpAttribute.FindString(text)
+		dialectLexer.tokens = append(dialectLexer.tokens, dialectLexer.token(start, token.Attribute, attribute))
+
+		return start + len(attribute), nil
+	case strings.HasPrefix(text, "["):
+		// Labels are lexed as usual, up to the closing bracket.
+		return dialectLexer.lexUntil(start, end, "]")
+	case strings.HasPrefix(text, `"`):
+		return dialectLexer.lexUntil(start, end, `"`)
+	case strings.HasPrefix(text, "#"):
+		// Comments run to the end of the line, as they do natively.
+		return dialectLexer.lexUntil(start, end, "\n")
+	default:
+		return start + 1, dialectLexer.lexPlain(start, start+1)
+	}
+}
+
+// Lex the input from start through the first of closing after it, or to end if
+// there is none, and return the offset after it.
+func (dialectLexer *dialectLexer) lexUntil(start, end int, closing string) (int, error) {
+	next := end
+	if index := strings.Index(dialectLexer.input[start+1:end], closing); index >= 0 {
+		next = start + 1 + index + len(closing)
+	}
+
+	return next, dialectLexer.lexPlain(start, next)
+}
+
+// Lex a Roll20 query such as ?{Bonus|2} as its default in parentheses. For a
+// list of options, as in ?{Weapon|Sword,1d8|Axe,1d6}, the default is the value
+// of the first option.
+func (dialectLexer *dialectLexer) lexQuery(start, end int) (int, error) {
+	text := dialectLexer.input[start:end]
+
+	closing := strings.IndexByte(text, '}') + 1
+	if closing == 0 {
+		closing = len(text)
+	}
+
+	_, options, hasDefault := strings.Cut(text[:closing], "|")
+	if !hasDefault {
+		// Queries without a default cannot be answered.
+		dialectLexer.tokens = append(dialectLexer.tokens, dialectLexer.token(start, token.Attribute, text[:closing]))
+
+		return start + closing, nil
+	}
+
+	option := strings.TrimSuffix(options, "}")
+	option, _, _ = strings.Cut(option, "|")
+	valueStart := start + closing - len(options)
+
+	if label, value, isCut := strings.Cut(option, ","); isCut {
+		valueStart += len(label) + 1
+		option = value
+	}
+
+	dialectLexer.tokens = append(dialectLexer.tokens, dialectLexer.token(start, token.LeftParentheses, "("))
+
+	if err := dialectLexer.lexPlain(valueStart, valueStart+len(option)); err != nil {
+		return 0, err
+	}
+
+	dialectLexer.tokens = append(dialectLexer.tokens, dialectLexer.token(start+closing-1, token.RightParentheses, ")"))
+
+	return start + closing, nil
+}
+
+// Lex the input from start to end as native syntax, without the end of input.
+func (dialectLexer *dialectLexer) lexPlain(start, end int) error {
+	lexer := dialectLexer.seek(start).Until(end)
+
+	for {
+		// Checking the context is cheap next to reading a token, but not
+		// free.
+		if len(dialectLexer.tokens)%contextInterval == 0 {
+			if err := dialectLexer.ctx.Err(); err != nil {
+				return err //nolint:wrapcheck
+			}
+		}
+
+		currentToken := lexer.Read()
+		if currentToken.Kind == token.EOF {
+			return nil
+		}
+
+		dialectLexer.tokens = append(dialectLexer.tokens, currentToken)
+	}
+}
+
+// Return a token that stands in for the text at offset.
+func (dialectLexer *dialectLexer) token(offset int, kind token.Kind, text string) token.Token {
+	position := dialectLexer.seek(offset).Position()
+
+	return token.New(position.Offset, position.Line, position.Column, kind, text)
+}
+
+// Return the cursor moved to offset. Offsets mostly increase as the input is
+// lexed, so the cursor only starts over from the start of the input when one
+// does not.
+func (dialectLexer *dialectLexer) seek(offset int) *lexer.Lexer {
+	if dialectLexer.cursor.Position().Offset > offset {
+		dialectLexer.cursor = lexer.New(dialectLexer.input)
+	}
+
+	dialectLexer.cursor.Seek(offset)
+
+	return dialectLexer.cursor
+}
+
+// Quote text as a string token.
+func quote(text string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text) + `"`
+}
+
+// Parse a formula as Avrae does: a single term, then "adv" or "dis" to roll its
+// first d20 with advantage or disadvantage, then a comment that names it.
+func (parser *parser) parseComment() (*ast.Formula, SyntaxErrors) {
+	start := parser.currentToken.Start()
+
+	term, err := parser.parseTerm()
+	if err != nil {
+		return &ast.Formula{Equations: []ast.Equation{}}, SyntaxErrors{err}
+	}
+
+	span := parser.spanFrom(start)
+
+	if parser.currentToken.Kind == token.Word {
+		switch strings.ToLower(parser.currentToken.String) {
+		case "adv":
+			term, _ = ast.KeepD20(term, 2, ast.KeepHighest) //nolint:gomnd
+			parser.readToken()
+		case "dis":
+			term, _ = ast.KeepD20(term, 2, ast.KeepLowest) //nolint:gomnd
+			parser.readToken()
+		}
+	}
+
+	name := ""
+	if parser.currentToken.Kind != token.EOF {
+		name = strings.Join(strings.Fields(parser.input[parser.currentToken.Offset:]), " ")
+	}
+
+	return &ast.Formula{Equations: []ast.Equation{{Name: name, Term: term, Span: span, Ordinal: 1}}}, nil
+}
+
+// Return the comparison of a target, such as the ">" of cs>19, and whether the
+// current token is one. Roll20 targets include the value compared to.
+func (parser *parser) targetComparison() (ast.Comparison, bool) {
+	if parser.dialect == Roll20 {
+		switch parser.currentToken.Kind { //nolint:exhaustive
+		case token.Greater:
+			return ast.GreaterEqual, true
+		case token.Less:
+			return ast.LessEqual, true
+		case token.Equal:
+			return ast.Equal, true
+		}
+	}
+
+	comparison, isComparison := comparisons[parser.currentToken.Kind]
+
+	return comparison, isComparison
+}
+
+// Parse the successes counted from pool, if any, where start is the position of
+// the pool. A comparison directly after the pool counts the values that match
+// when counts is set, as it is for groups and, in Roll20, dice. Foundry counts
+// with cs and cf instead, as in 10d6cs>=5.
+func (parser *parser) parseSuccesses(start token.Position, pool ast.Pool, counts bool) (ast.Term, *SyntaxError) {
+	comparison, isComparison := parser.targetComparison()
+
+	switch {
+	case parser.dialect == Foundry && parser.currentToken.Kind == token.Word &&
+		regexpFoundryCount.MatchString(parser.currentToken.String):
+		target := regexpFoundryCount.FindStringSubmatch(parser.currentToken.String)[1]
+
+		parser.readToken()
+
+		if target != "" {
+			value, fits := token.New(0, 0, 0, token.Int, target).Int()
+			if !fits {
+				return nil, parser.expected(smallerInteger)
+			}
+
+			return ast.SuccessTerm{Pool: pool, Comparison: ast.Equal, Target: value, Span: parser.spanFrom(start)}, nil
+		}
+
+		if comparison, isComparison = parser.targetComparison(); !isComparison {
+			return nil, parser.expected("comparison")
+		}
+	case isComparison && counts:
+	default:
+		return pool, nil
+	}
+
+	parser.readToken()
+
+	target, err := parser.parseSignedInt()
+	if err != nil {
+		return nil, err
+	}
+
+	return ast.SuccessTerm{Pool: pool, Comparison: comparison, Target: target, Span: parser.spanFrom(start)}, nil
+}
+
+// Matches Foundry's count modifiers, with an optional target that the dice
+// must equal.
+var regexpFoundryCount = regexp.MustCompile(`(?i)\Ac[sf](\d*)\z`)
+
+// Report whether the parenthesis at the current token starts an Avrae group,
+// which has a comma before its closing parenthesis.
+func (parser *parser) atParenthesisedGroup() bool {
+	depth := 0
+
+	for _, currentToken := range parser.tokens[parser.position:] {
+		switch {
+		case currentToken.Kind == token.Comma && depth == 1:
+			return true
+		case currentToken.Kind == token.EOF:
+			return false
+		}
+
+		if depth += bracketDepth(currentToken.Kind); depth == 0 {
+			return false
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,67 @@
+package parser_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/parser"
+)
+
+func TestDialects(t *testing.T) {
+	t.Parallel()
+
+	data, err := os.ReadFile("testdata/macros.txt")
+	assert.NoError(t, err)
+
+	for _, macro := range strings.Split(strings.TrimSpace(string(data)), "\n\n") {
+		if strings.HasPrefix(macro, "#") {
+			continue
+		}
+
+		lines := strings.Split(macro, "\n")
+		name, input, _ := strings.Cut(lines[0], ": ")
+
+		dialect, isDialect := parser.DialectNamed(name)
+		assert.True(t, isDialect, "%q should be a dialect", name)
+
+		formula, err := parser.ParseDialect(context.Background(), input, dialect)
+
+		actual := formula.String()
+		if err != nil {
+			actual = err.Error()
+		}
+
+		assert.Equal(t, strings.Join(lines[1:], "\n"), actual, "%v macro %q should parse", dialect, input)
+	}
+
+	// Errors point at the macro as it was typed.
+	input := "&{template:default} {{attack=[[1d20+*2]]}}"
+	_, err = parser.ParseDialect(context.Background(), input, parser.Roll20)
+
+	var syntaxErrors parser.SyntaxErrors
+	if assert.ErrorAs(t, err, &syntaxErrors) {
+		assert.Equal(t, input+"\n"+strings.Repeat(" ", 36)+"^", syntaxErrors[0].Diagnostic(input))
+	}
+
+	// So do warnings about attributes, which are read as 0.
+	input = "&{template:default} {{attack=[[1d1+@{str}-?{Bonus}]]}}"
+	formula, err := parser.ParseDialect(context.Background(), input, parser.Roll20)
+	assert.NoError(t, err)
+
+	warnings := []string{}
+
+	for _, warning := range ast.Lint(formula) {
+		warnings = append(warnings, warning.String())
+	}
+
+	assert.Equal(t, []string{
+		"line 1 column 32: 1d1 always rolls 1",
+		"line 1 column 36: @{str} is read as 0, since there is no character sheet to read it from",
+		"line 1 column 43: ?{Bonus} is read as 0, since it has no default answer",
+	}, warnings)
+	assert.Equal(t, 1, ast.NewEvaluator().EvaluateFormula(formula)[0].Value)
+}
@@ -0,0 +1,57 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+// SyntaxError reports the token where the parser expected something else.
+type SyntaxError struct {
+	Expected []string
+	Received token.Token
+	// Suggestion is what the user may have meant to type, if anything.
+	Suggestion string
+}
+
+func (syntaxError *SyntaxError) Error() string {
+	message := fmt.Sprintf("line %v column %v: expected %v, got %v",
+		syntaxError.Received.Line,
+		syntaxError.Received.Column,
+		strings.Join(syntaxError.Expected, " or "),
+		syntaxError.Received.Quote())
+
+	if syntaxError.Suggestion != "" {
+		message += fmt.Sprintf(`; did you mean "%v"?`, syntaxError.Suggestion)
+	}
+
+	return message
+}
+
+// Diagnostic renders the line of input containing the error with carets under
+// the offending token.
+func (syntaxError *SyntaxError) Diagnostic(input string) string {
+	span := syntaxError.Received.Span()
+
+	// The end of input is reported at the last character, so point after it.
+	if syntaxError.Received.Kind == token.EOF {
+		span.Start.Column++
+		span.End.Column++
+	}
+
+	return span.Diagnostic(input)
+}
+
+// SyntaxErrors lists every syntax error in a formula in the order they appear.
+type SyntaxErrors []*SyntaxError
+
+func (syntaxErrors SyntaxErrors) Error() string {
+	messages := make([]string, 0, len(syntaxErrors))
+
+	for _, syntaxError := range syntaxErrors {
+		messages = append(messages, syntaxError.Error())
+	}
+
+	return strings.Join(messages, "\n")
+}
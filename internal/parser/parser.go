@@ -1,77 +1,212 @@
 package parser
 
 import (
+	"context"
+	"math"
+	"regexp"
 	"strings"
+	"unicode/utf8"
 
 	"meganruggiero.com/dicebot/internal/ast"
-	"meganruggiero.com/dicebot/internal/lexer"
 	"meganruggiero.com/dicebot/internal/token"
 )
 
+// Parse a formula, recovering from syntax errors so that they can all be
+// reported at once. When err is not nil it is a SyntaxErrors and the formula
+// holds the equations that parsed cleanly.
 func Parse(input string) (*ast.Formula, error) {
-	parser := parser{
-		lexer:        lexer.New(input),
-		currentToken: token.New(0, 0, token.Unrecognized, ""),
-	}
-
-	parser.readToken()
-
-	formula, err := parser.parseFormula()
-	if err != nil {
-		return nil, err
-	}
+	return ParseContext(context.Background(), input)
+}
 
-	return formula, nil
+// ParseContext is like Parse, but stops once ctx is done and returns its error
+// with the equations parsed so far.
+func ParseContext(ctx context.Context, input string) (*ast.Formula, error) {
+	return ParseDialect(ctx, input, Native)
 }
 
+// How many tokens to read between checks of the context.
+const contextInterval = 256
+
 type parser struct {
-	lexer        *lexer.Lexer
+	input        string
+	dialect      Dialect
+	tokens       []token.Token
+	position     int
 	currentToken token.Token
+	nextToken    token.Token
+}
+
+func (parser *parser) expected(expected ...string) *SyntaxError {
+	return &SyntaxError{Expected: expected, Received: parser.currentToken, Suggestion: ""}
 }
 
-func (parser *parser) expected(expected ...string) *expectation {
-	return &expectation{expected: expected, received: parser.currentToken}
+// Like expected, but suggest what the user may have meant. An empty suggestion
+// is ignored.
+func (parser *parser) suggest(suggestion string, expected ...string) *SyntaxError {
+	return &SyntaxError{Expected: expected, Received: parser.currentToken, Suggestion: suggestion}
+}
+
+// Return the token at offset from the current one, or EOF past the end.
+func (parser *parser) peek(offset int) token.Token {
+	return parser.tokens[min(parser.position+offset, len(parser.tokens)-1)]
+}
+
+// Move to the token at position. The last token is always EOF, so reading past
+// it keeps returning EOF.
+func (parser *parser) seek(position int) {
+	last := len(parser.tokens) - 1
+
+	parser.position = min(position, last)
+	parser.currentToken = parser.tokens[parser.position]
+	parser.nextToken = parser.tokens[min(parser.position+1, last)]
 }
 
 func (parser *parser) readToken() {
-	nextToken := parser.lexer.Read()
-	parser.currentToken = nextToken
+	parser.seek(parser.position + 1)
 }
 
-func (parser *parser) parseFormula() (*ast.Formula, *expectation) {
+// Return the span from start to the end of the last token read.
+func (parser *parser) spanFrom(start token.Position) token.Span {
+	return token.Span{Start: start, End: parser.tokens[max(parser.position-1, 0)].End()}
+}
+
+func (parser *parser) parseFormula(ctx context.Context) (*ast.Formula, SyntaxErrors) {
 	equations := []ast.Equation{}
+	syntaxErrors := SyntaxErrors{}
+	// Count equations that fail to parse too, so that the rest keep the
+	// ordinals they were written with.
+	ordinal := 0
+
+	for parser.currentToken.Kind != token.EOF && ctx.Err() == nil {
+		// Commas between equations are optional.
+		if parser.currentToken.Kind == token.Comma {
+			parser.readToken()
+
+			continue
+		}
+
+		start := parser.position
+		ordinal++
 
-	for parser.currentToken.Kind != token.EOF {
 		equation, err := parser.parseEquation()
 		if err != nil {
-			return nil, err
+			syntaxErrors = append(syntaxErrors, err)
+			parser.synchronize(start)
+
+			continue
 		}
 
+		equation.Ordinal = ordinal
 		equations = append(equations, *equation)
 	}
 
-	return &ast.Formula{Equations: equations}, nil
+	return &ast.Formula{Equations: equations}, syntaxErrors
+}
+
+// Skip past a syntax error to where the next equation is likely to start: after
+// a comma outside of any brackets, at the start of a line or at a name followed
+// by "=".
+func (parser *parser) synchronize(start int) {
+	// Count the brackets left open by the equation so far so that commas
+	// between arguments or group members are skipped.
+	depth := 0
+
+	for _, currentToken := range parser.tokens[start:parser.position] {
+		depth += bracketDepth(currentToken.Kind)
+	}
+
+	// Move past the token that caused the error so that it is not reported
+	// twice, unless it ends the equation or starts a name.
+	atComma := parser.currentToken.Kind == token.Comma && depth <= 0
+	if parser.position == start || !(atComma || parser.atName()) {
+		depth += bracketDepth(parser.currentToken.Kind)
+		parser.readToken()
+	}
+
+	for {
+		switch {
+		case parser.currentToken.Kind == token.EOF:
+			return
+		case parser.currentToken.Kind == token.Comma && depth <= 0:
+			parser.readToken()
+
+			return
+		case parser.currentToken.Line != parser.tokens[parser.position-1].Line, parser.atName():
+			return
+		}
+
+		depth += bracketDepth(parser.currentToken.Kind)
+		parser.readToken()
+	}
 }
 
-func (parser *parser) parseEquation() (*ast.Equation, *expectation) {
+func bracketDepth(kind token.Kind) int {
+	switch kind { //nolint:exhaustive
+	case token.LeftParentheses, token.LeftBrace:
+		return 1
+	case token.RightParentheses, token.RightBrace:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// Report whether the current token starts an equation name.
+func (parser *parser) atName() bool {
+	position := parser.position
+
+	for position < len(parser.tokens) {
+		switch parser.tokens[position].Kind { //nolint:exhaustive
+		case token.Word, token.String:
+			position++
+		case token.Equal:
+			return position > parser.position
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+func (parser *parser) parseEquation() (*ast.Equation, *SyntaxError) {
+	start := parser.currentToken.Start()
+
 	name, err := parser.parseOptionalEquationName()
 	if err != nil {
 		return nil, err
 	}
 
-	term, err := parser.parseMDTerm()
+	term, err := parser.parseTerm()
 	if err != nil {
 		return nil, err
 	}
 
-	return &ast.Equation{Name: name, Term: term}, nil
+	return &ast.Equation{Name: name, Term: term, Span: parser.spanFrom(start), Ordinal: 0}, nil
 }
 
-func (parser *parser) parseOptionalEquationName() (string, *expectation) {
+func (parser *parser) parseOptionalEquationName() (string, *SyntaxError) {
 	words := []string{}
 
-	for parser.currentToken.Kind == token.Word {
-		words = append(words, parser.currentToken.String)
+	// Advantage keywords start a term unless they are part of a name, as in
+	// "adv = 2d20kh1".
+	if _, isAdvantage := parser.atAdvantage(); isAdvantage && !parser.atName() {
+		return "", nil
+	}
+
+	for {
+		// A word followed by "(" is a function call rather than part
+		// of a name, and "d 20" is a mistyped dice term.
+		if parser.currentToken.Kind == token.Word &&
+			parser.nextToken.Kind != token.LeftParentheses &&
+			!parser.isSpacedDice(0) {
+			words = append(words, parser.currentToken.String)
+		} else if parser.currentToken.Kind == token.String {
+			words = append(words, parser.currentToken.Unquote())
+		} else {
+			break
+		}
+
 		parser.readToken()
 	}
 
@@ -88,7 +223,72 @@ func (parser *parser) parseOptionalEquationName() (string, *expectation) {
 	return strings.Join(words, " "), nil
 }
 
-func (parser *parser) parseMDTerm() (ast.Term, *expectation) {
+// Expected in place of integers that are too large for an int where one is
+// needed, such as dice counts.
+const smallerInteger = "smaller integer"
+
+var comparisons = map[token.Kind]ast.Comparison{ //nolint:exhaustive
+	token.EqualEqual:   ast.Equal,
+	token.NotEqual:     ast.NotEqual,
+	token.Less:         ast.Less,
+	token.LessEqual:    ast.LessEqual,
+	token.Greater:      ast.Greater,
+	token.GreaterEqual: ast.GreaterEqual,
+}
+
+// Matches one or more keep/drop or critical modifiers, such as "kh1",
+// "dl1kh2" or "cf1cs".
+var (
+	regexpModifiers = regexp.MustCompile(`(?i)\A(?:(?:kh|kl|dh|dl|k|cs|cf)\d*)+\z`)
+	regexpModifier  = regexp.MustCompile(`(?i)(kh|kl|dh|dl|ph|pl|k|cs|cf)(\d*)`)
+)
+
+var selections = map[string]ast.Selection{
+	"k":  ast.KeepHighest,
+	"kh": ast.KeepHighest,
+	"kl": ast.KeepLowest,
+	"dh": ast.DropHighest,
+	"dl": ast.DropLowest,
+	// Avrae "pops" dice rather than dropping them.
+	"ph": ast.DropHighest,
+	"pl": ast.DropLowest,
+}
+
+var criticals = map[string]ast.Critical{
+	"cs": ast.CriticalSuccess,
+	"cf": ast.CriticalFailure,
+}
+
+func (parser *parser) parseTerm() (ast.Term, *SyntaxError) {
+	return parser.parseCompareTerm()
+}
+
+func (parser *parser) parseCompareTerm() (ast.Term, *SyntaxError) {
+	start := parser.currentToken.Start()
+
+	left, err := parser.parseMDTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	comparison, isComparison := comparisons[parser.currentToken.Kind]
+	if !isComparison {
+		return left, nil
+	}
+
+	parser.readToken()
+
+	right, err := parser.parseMDTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	return ast.CompareTerm{Comparison: comparison, Left: left, Right: right, Span: parser.spanFrom(start)}, nil
+}
+
+func (parser *parser) parseMDTerm() (ast.Term, *SyntaxError) {
+	start := parser.currentToken.Start()
+
 	left, err := parser.parseASTerm()
 	if err != nil {
 		return nil, err
@@ -104,7 +304,7 @@ func (parser *parser) parseMDTerm() (ast.Term, *expectation) {
 				return nil, err
 			}
 
-			left = ast.MultiplyTerm{Left: left, Right: right}
+			left = ast.MultiplyTerm{Left: left, Right: right, Span: parser.spanFrom(start)}
 		case token.Divide:
 			parser.readToken()
 
@@ -113,15 +313,17 @@ func (parser *parser) parseMDTerm() (ast.Term, *expectation) {
 				return nil, err
 			}
 
-			left = ast.DivideTerm{Left: left, Right: right}
+			left = ast.DivideTerm{Left: left, Right: right, Span: parser.spanFrom(start)}
 		default:
 			return left, nil
 		}
 	}
 }
 
-func (parser *parser) parseASTerm() (ast.Term, *expectation) {
-	left, err := parser.parseBottomTerm()
+func (parser *parser) parseASTerm() (ast.Term, *SyntaxError) {
+	start := parser.currentToken.Start()
+
+	left, err := parser.parseLabelledTerm()
 	if err != nil {
 		return nil, err
 	}
@@ -131,48 +333,76 @@ func (parser *parser) parseASTerm() (ast.Term, *expectation) {
 		case token.Add:
 			parser.readToken()
 
-			right, err := parser.parseBottomTerm()
+			right, err := parser.parseLabelledTerm()
 			if err != nil {
 				return nil, err
 			}
 
-			left = ast.AddTerm{Left: left, Right: right}
+			left = ast.AddTerm{Left: left, Right: right, Span: parser.spanFrom(start)}
 		case token.Subtract:
 			parser.readToken()
 
-			right, err := parser.parseBottomTerm()
+			right, err := parser.parseLabelledTerm()
 			if err != nil {
 				return nil, err
 			}
 
-			left = ast.SubtractTerm{Left: left, Right: right}
+			left = ast.SubtractTerm{Left: left, Right: right, Span: parser.spanFrom(start)}
 		default:
 			return left, nil
 		}
 	}
 }
 
+func (parser *parser) parseLabelledTerm() (ast.Term, *SyntaxError) {
+	start := parser.currentToken.Start()
+
+	term, err := parser.parseBottomTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.currentToken.Kind == token.Label {
+		label := parser.currentToken.LabelText()
+
+		parser.readToken()
+
+		term = ast.LabelTerm{Term: term, Label: label, Span: parser.spanFrom(start)}
+	}
+
+	return term, nil
+}
+
 //nolint:cyclop
-func (parser *parser) parseBottomTerm() (ast.Term, *expectation) {
+func (parser *parser) parseBottomTerm() (ast.Term, *SyntaxError) {
+	start := parser.currentToken.Start()
+
 	switch parser.currentToken.Kind { //nolint:exhaustive
 	case token.D:
-		faces := parser.currentToken.Int()
-		parser.readToken()
-
-		return ast.DiceTerm{Count: 1, Faces: faces}, nil
+		return parser.parseModifiedDice(start, ast.IntTerm{Value: 1, Span: token.Span{}})
 	case token.Int:
-		intOrCount := parser.currentToken.Int()
+		if suggestion := parser.suggestDice(); suggestion != "" {
+			parser.readToken()
+
+			return nil, parser.suggest(suggestion, "dice term")
+		}
+
+		// Integers too large for an int are promoted, but dice counts
+		// must fit.
+		value := parser.currentToken.BigInt()
+		if parser.nextToken.Kind == token.D && !token.FitsInt(value) {
+			return nil, parser.expected(smallerInteger)
+		}
+
+		intOrCount := ast.NewIntTerm(value, parser.currentToken.Span())
 
 		parser.readToken()
 
 		if parser.currentToken.Kind == token.D {
-			faces := parser.currentToken.Int()
-			parser.readToken()
-
-			return ast.DiceTerm{Count: intOrCount, Faces: faces}, nil
+			return parser.parseModifiedDice(start, intOrCount)
 		}
 
-		return ast.IntTerm{Value: intOrCount}, nil
+		return intOrCount, nil
 	case token.Add:
 		parser.readToken()
 
@@ -180,9 +410,11 @@ func (parser *parser) parseBottomTerm() (ast.Term, *expectation) {
 			return nil, parser.expected("integer")
 		}
 
+		value := parser.currentToken.BigInt()
+
 		parser.readToken()
 
-		return ast.IntTerm{Value: +parser.currentToken.Int()}, nil
+		return ast.NewIntTerm(value, parser.spanFrom(start)), nil
 	case token.Subtract:
 		parser.readToken()
 
@@ -190,25 +422,419 @@ func (parser *parser) parseBottomTerm() (ast.Term, *expectation) {
 			return nil, parser.expected("integer")
 		}
 
+		value := parser.currentToken.BigInt()
+
 		parser.readToken()
 
-		return ast.IntTerm{Value: -parser.currentToken.Int()}, nil
+		return ast.NewIntTerm(value.Neg(value), parser.spanFrom(start)), nil
+	case token.Word:
+		if _, isAdvantage := parser.atAdvantage(); isAdvantage {
+			return parser.parseAdvantage()
+		}
+
+		if parser.isSpacedDice(0) {
+			return nil, parser.suggest(parser.currentToken.String+parser.nextToken.String, "integer", "dice term", `"("`)
+		}
+
+		if parser.nextToken.Kind != token.LeftParentheses {
+			return nil, parser.expected("integer", "dice term", `"("`)
+		}
+
+		return parser.parseCall()
 	case token.LeftParentheses:
-		parser.readToken()
+		if parser.dialect == Avrae && parser.atParenthesisedGroup() {
+			return parser.parseGroup()
+		}
 
-		term, err := parser.parseMDTerm()
+		term, err := parser.parseParenthesised()
 		if err != nil {
 			return nil, err
 		}
 
-		if parser.currentToken.Kind != token.RightParentheses {
-			return nil, parser.expected(`")"`)
+		if parser.currentToken.Kind == token.D {
+			return parser.parseModifiedDice(start, term)
 		}
 
+		return term, nil
+	case token.LeftBrace:
+		return parser.parseGroup()
+	case token.Attribute:
+		// Other tools read these from character sheets, which we do not
+		// have, so they are read as 0 with a warning.
+		attribute := parser.currentToken
+
 		parser.readToken()
 
-		return term, nil
+		return ast.AttributeTerm{Name: attribute.String, Span: attribute.Span()}, nil
 	default:
 		return nil, parser.expected("integer", "dice term", `"("`)
 	}
 }
+
+func (parser *parser) parseParenthesised() (ast.Term, *SyntaxError) {
+	if parser.currentToken.Kind != token.LeftParentheses {
+		return nil, parser.expected(`"("`)
+	}
+
+	parser.readToken()
+
+	term, err := parser.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.currentToken.Kind != token.RightParentheses {
+		return nil, parser.expected(`")"`)
+	}
+
+	parser.readToken()
+
+	return term, nil
+}
+
+// Parse a dice term and its modifiers, where start is the position of the
+// count, or of the "d" when there is no count.
+func (parser *parser) parseModifiedDice(start token.Position, count ast.Term) (ast.Term, *SyntaxError) {
+	pool, err := parser.parseDice(start, count)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err = parser.parseModifiers(start, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	return parser.parseSuccesses(start, pool, parser.dialect == Roll20)
+}
+
+func (parser *parser) parseDice(start token.Position, count ast.Term) (ast.Pool, *SyntaxError) {
+	intCount, isIntCount := count.(ast.IntTerm)
+
+	if _, size := utf8.DecodeRuneInString(parser.currentToken.String); len(parser.currentToken.String) > size {
+		// The faces are the digits after the "d".
+		facesSpan := parser.currentToken.Span()
+		facesSpan.Start.Offset += size
+		facesSpan.Start.Column++
+
+		value, fits := parser.currentToken.Int()
+		if !fits {
+			return nil, parser.expected(smallerInteger)
+		}
+
+		faces := ast.IntTerm{Value: value, Span: facesSpan}
+
+		parser.readToken()
+
+		if isIntCount {
+			return ast.DiceTerm{Count: intCount.Value, Faces: faces.Value, Span: parser.spanFrom(start)}, nil
+		}
+
+		return ast.DynamicDiceTerm{Count: count, Faces: faces, Span: parser.spanFrom(start)}, nil
+	}
+
+	// A "d" without digits is followed by a parenthesised term or a list
+	// of faces.
+	parser.readToken()
+
+	if parser.currentToken.Kind == token.LeftBrace && isIntCount {
+		faces, err := parser.parseFaces()
+		if err != nil {
+			return nil, err
+		}
+
+		return ast.CustomDiceTerm{Count: intCount.Value, Faces: faces, Span: parser.spanFrom(start)}, nil
+	}
+
+	faces, err := parser.parseParenthesised()
+	if err != nil {
+		return nil, err
+	}
+
+	return ast.DynamicDiceTerm{Count: count, Faces: faces, Span: parser.spanFrom(start)}, nil
+}
+
+func (parser *parser) parseFaces() ([]ast.Face, *SyntaxError) {
+	if parser.currentToken.Kind != token.LeftBrace {
+		return nil, parser.expected(`"{"`)
+	}
+
+	parser.readToken()
+
+	faces := []ast.Face{}
+	totalWeight := 0
+
+	for {
+		face, err := parser.parseFace(totalWeight)
+		if err != nil {
+			return nil, err
+		}
+
+		faces = append(faces, face)
+		totalWeight += face.Weight
+
+		switch parser.currentToken.Kind { //nolint:exhaustive
+		case token.Comma:
+			parser.readToken()
+		case token.RightBrace:
+			parser.readToken()
+
+			return faces, nil
+		default:
+			return nil, parser.expected(`","`, `"}"`)
+		}
+	}
+}
+
+// Parse a face of a custom die. Dice are rolled by picking from the total
+// weight of their faces, so the weight must not take it past an int.
+func (parser *parser) parseFace(totalWeight int) (ast.Face, *SyntaxError) {
+	value, err := parser.parseSignedInt()
+	if err != nil {
+		return ast.Face{}, err
+	}
+
+	face := ast.Face{Value: value, Weight: 1}
+
+	if parser.currentToken.Kind != token.Colon {
+		return face, nil
+	}
+
+	parser.readToken()
+
+	weight, fits := parser.currentToken.Int()
+	if parser.currentToken.Kind != token.Int || weight == 0 {
+		return ast.Face{}, parser.expected("positive integer")
+	}
+
+	if !fits || weight > math.MaxInt-totalWeight {
+		return ast.Face{}, parser.expected(smallerInteger)
+	}
+
+	face.Weight = weight
+
+	parser.readToken()
+
+	return face, nil
+}
+
+func (parser *parser) parseSignedInt() (int, *SyntaxError) {
+	sign := 1
+
+	switch parser.currentToken.Kind { //nolint:exhaustive
+	case token.Add:
+		parser.readToken()
+	case token.Subtract:
+		sign = -1
+
+		parser.readToken()
+	}
+
+	if parser.currentToken.Kind != token.Int {
+		return 0, parser.expected("integer")
+	}
+
+	value := parser.currentToken.BigInt()
+	if sign < 0 {
+		value.Neg(value)
+	}
+
+	if !token.FitsInt(value) {
+		return 0, parser.expected(smallerInteger)
+	}
+
+	parser.readToken()
+
+	return int(value.Int64()), nil
+}
+
+// Parse a group in braces, or in Avrae, parentheses.
+func (parser *parser) parseGroup() (ast.Term, *SyntaxError) {
+	start := parser.currentToken.Start()
+	closing, expectedClosing := token.RightBrace, `"}"`
+
+	if parser.currentToken.Kind == token.LeftParentheses {
+		closing, expectedClosing = token.RightParentheses, `")"`
+	}
+
+	parser.readToken()
+
+	group := ast.GroupTerm{Members: []ast.Term{}, Span: token.Span{}}
+
+	for {
+		member, err := parser.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+
+		group.Members = append(group.Members, member)
+
+		if parser.currentToken.Kind == closing {
+			parser.readToken()
+
+			group.Span = parser.spanFrom(start)
+
+			break
+		}
+
+		if parser.currentToken.Kind != token.Comma {
+			return nil, parser.expected(`","`, expectedClosing)
+		}
+
+		parser.readToken()
+	}
+
+	pool, err := parser.parseModifiers(start, group)
+	if err != nil {
+		return nil, err
+	}
+
+	return parser.parseSuccesses(start, pool, true)
+}
+
+// Wrap pool in any keep/drop and critical modifiers that follow it, where start
+// is the position of the pool.
+func (parser *parser) parseModifiers(start token.Position, pool ast.Pool) (ast.Pool, *SyntaxError) {
+	for parser.currentToken.Kind == token.Word && dialectModifiers[parser.dialect].MatchString(parser.currentToken.String) ||
+		parser.atDropDice() {
+		if parser.currentToken.Kind == token.D {
+			count := modifierCount(parser.currentToken.String[1:])
+
+			parser.readToken()
+
+			pool = ast.KeepTerm{Pool: pool, Selection: ast.DropLowest, Count: count, Span: parser.spanFrom(start)}
+
+			continue
+		}
+
+		matches := regexpModifier.FindAllStringSubmatch(parser.currentToken.String, -1)
+
+		parser.readToken()
+
+		for index, match := range matches {
+			name := strings.ToLower(match[1])
+			count := modifierCount(match[2])
+
+			if selection, isSelection := selections[name]; isSelection {
+				pool = ast.KeepTerm{Pool: pool, Selection: selection, Count: count, Span: parser.spanFrom(start)}
+
+				continue
+			}
+
+			critTerm := ast.CriticalTerm{
+				Pool:       pool,
+				Critical:   criticals[name],
+				Comparison: ast.Equal,
+				Target:     count,
+				Span:       parser.spanFrom(start),
+			}
+
+			// Only the last critical modifier in a word may be followed
+			// by a comparison, as in "cs>=19".
+			if match[2] == "" {
+				comparison, isComparison := parser.targetComparison()
+				if index != len(matches)-1 || !isComparison {
+					return nil, parser.expected("comparison")
+				}
+
+				parser.readToken()
+
+				target, err := parser.parseSignedInt()
+				if err != nil {
+					return nil, err
+				}
+
+				critTerm.Comparison = comparison
+				critTerm.Target = target
+				critTerm.Span = parser.spanFrom(start)
+			}
+
+			pool = critTerm
+		}
+	}
+
+	return pool, nil
+}
+
+// Return the count of a modifier from its digits, which default to 1.
+func modifierCount(digits string) int {
+	if digits == "" {
+		return 1
+	}
+
+	// Counts too large for an int keep every die and targets that large
+	// match none, just like the largest int.
+	value, fits := token.New(0, 0, 0, token.Int, digits).Int()
+	if !fits {
+		return math.MaxInt
+	}
+
+	return value
+}
+
+// Report whether the current token drops dice in the style of Roll20 and
+// Foundry, as the "d1" of 4d6d1 does.
+func (parser *parser) atDropDice() bool {
+	return (parser.dialect == Roll20 || parser.dialect == Foundry) &&
+		parser.currentToken.Kind == token.D &&
+		len(parser.currentToken.String) > 1 &&
+		adjacent(parser.tokens[parser.position-1], parser.currentToken)
+}
+
+func (parser *parser) parseCall() (ast.Term, *SyntaxError) {
+	start := parser.currentToken.Start()
+
+	if !strings.EqualFold(parser.currentToken.String, "if") {
+		return nil, parser.suggest(closestWord(parser.currentToken.String, functions), `"if"`)
+	}
+
+	parser.readToken()
+
+	arguments, err := parser.parseArguments(3) //nolint:gomnd
+	if err != nil {
+		return nil, err
+	}
+
+	return ast.ConditionalTerm{
+		Condition: arguments[0],
+		Then:      arguments[1],
+		Else:      arguments[2],
+		Span:      parser.spanFrom(start),
+	}, nil
+}
+
+// Parse exactly count comma-separated terms enclosed in parentheses.
+func (parser *parser) parseArguments(count int) ([]ast.Term, *SyntaxError) {
+	if parser.currentToken.Kind != token.LeftParentheses {
+		return nil, parser.expected(`"("`)
+	}
+
+	parser.readToken()
+
+	arguments := make([]ast.Term, 0, count)
+
+	for index := 0; index < count; index++ {
+		if index > 0 {
+			if parser.currentToken.Kind != token.Comma {
+				return nil, parser.expected(`","`)
+			}
+
+			parser.readToken()
+		}
+
+		argument, err := parser.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+
+		arguments = append(arguments, argument)
+	}
+
+	if parser.currentToken.Kind != token.RightParentheses {
+		return nil, parser.expected(`")"`)
+	}
+
+	parser.readToken()
+
+	return arguments, nil
+}
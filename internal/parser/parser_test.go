@@ -1,11 +1,16 @@
 package parser_test
 
 import (
+	"context"
+	"math"
+	"math/big"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"meganruggiero.com/dicebot/internal/ast"
 	"meganruggiero.com/dicebot/internal/parser"
+	"meganruggiero.com/dicebot/internal/token"
 )
 
 func TestLexer(t *testing.T) {
@@ -44,25 +49,438 @@ func TestLexer(t *testing.T) {
 		{Name: "unary operations aka signs", Term: ast.SubtractTerm{
 			Left: ast.AddTerm{
 				Left:  ast.IntTerm{Value: 1},
-				Right: ast.IntTerm{Value: 0},
+				Right: ast.IntTerm{Value: 1},
 			},
-			Right: ast.IntTerm{Value: 0},
+			Right: ast.IntTerm{Value: -1},
 		}},
-	}}, formula)
+	}}, ast.WithoutSpans(formula))
 
 	formula, err = parser.Parse("2d4 + d20 - -1, keyword 4 D8")
 	assert.EqualError(t, err, `line 1 column 25: expected "=", got "4"`)
-	assert.Nil(t, formula)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.SubtractTerm{
+			Left:  ast.AddTerm{Left: ast.DiceTerm{Count: 2, Faces: 4}, Right: ast.DiceTerm{Count: 1, Faces: 20}},
+			Right: ast.IntTerm{Value: -1},
+		}},
+	}}, ast.WithoutSpans(formula))
 
 	formula, err = parser.Parse("!")
 	assert.EqualError(t, err, `line 1 column 1: expected integer or dice term or "(", got "!"`)
-	assert.Nil(t, formula)
+	assert.Empty(t, formula.Equations)
 
 	formula, err = parser.Parse("1 ! 2")
 	assert.EqualError(t, err, `line 1 column 3: expected integer or dice term or "(", got "!"`)
-	assert.Nil(t, formula)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{{Name: "", Term: ast.IntTerm{Value: 1}}}}, ast.WithoutSpans(formula))
 
 	formula, err = parser.Parse("(5d8")
 	assert.EqualError(t, err, `line 1 column 4: expected ")", got end of input`)
-	assert.Nil(t, formula)
+	assert.Empty(t, formula.Equations)
+}
+
+func TestConditionals(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse("if(d20 >= 15, 2d8+4, 0), check = IF(1d6 == 6, 1, 1d6 != 1)")
+	assert.NoError(t, err)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.ConditionalTerm{
+			Condition: ast.CompareTerm{
+				Comparison: ast.GreaterEqual,
+				Left:       ast.DiceTerm{Count: 1, Faces: 20},
+				Right:      ast.IntTerm{Value: 15},
+			},
+			Then: ast.AddTerm{
+				Left:  ast.DiceTerm{Count: 2, Faces: 8},
+				Right: ast.IntTerm{Value: 4},
+			},
+			Else: ast.IntTerm{Value: 0},
+		}},
+		{Name: "check", Term: ast.ConditionalTerm{
+			Condition: ast.CompareTerm{
+				Comparison: ast.Equal,
+				Left:       ast.DiceTerm{Count: 1, Faces: 6},
+				Right:      ast.IntTerm{Value: 6},
+			},
+			Then: ast.IntTerm{Value: 1},
+			Else: ast.CompareTerm{
+				Comparison: ast.NotEqual,
+				Left:       ast.DiceTerm{Count: 1, Faces: 6},
+				Right:      ast.IntTerm{Value: 1},
+			},
+		}},
+	}}, ast.WithoutSpans(formula))
+
+	formula, err = parser.Parse("if(d20 >= 15, 2d8+4)")
+	assert.EqualError(t, err, `line 1 column 20: expected ",", got ")"`)
+	assert.Empty(t, formula.Equations)
+
+	formula, err = parser.Parse("when(d20 >= 15, 2d8+4, 0)")
+	assert.EqualError(t, err, `line 1 column 1: expected "if", got "when"`)
+	assert.Empty(t, formula.Equations)
+}
+
+func TestCustomDice(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse("d{1,1,2,3,5,8} 3D{-1, 0, +1}, weighted = 2d{1:3, 6:1}")
+	assert.NoError(t, err)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.CustomDiceTerm{Count: 1, Faces: []ast.Face{
+			{Value: 1, Weight: 1},
+			{Value: 1, Weight: 1},
+			{Value: 2, Weight: 1},
+			{Value: 3, Weight: 1},
+			{Value: 5, Weight: 1},
+			{Value: 8, Weight: 1},
+		}}},
+		{Name: "", Term: ast.CustomDiceTerm{Count: 3, Faces: []ast.Face{
+			{Value: -1, Weight: 1},
+			{Value: 0, Weight: 1},
+			{Value: 1, Weight: 1},
+		}}},
+		{Name: "weighted", Term: ast.CustomDiceTerm{Count: 2, Faces: []ast.Face{
+			{Value: 1, Weight: 3},
+			{Value: 6, Weight: 1},
+		}}},
+	}}, ast.WithoutSpans(formula))
+
+	formula, err = parser.Parse("d{}")
+	assert.EqualError(t, err, `line 1 column 3: expected integer, got "}"`)
+	assert.Empty(t, formula.Equations)
+
+	formula, err = parser.Parse("d{1:0}")
+	assert.EqualError(t, err, `line 1 column 5: expected positive integer, got "0"`)
+	assert.Empty(t, formula.Equations)
+
+	// The total weight must fit in an int.
+	_, err = parser.Parse("1d{1:9223372036854775806, 2:1}")
+	assert.NoError(t, err)
+
+	formula, err = parser.Parse("1d{1:9223372036854775807, 2:1}")
+	assert.EqualError(t, err, `line 1 column 29: expected smaller integer, got "1"`)
+	assert.Empty(t, formula.Equations)
+}
+
+func TestDynamicDice(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse("(1d4)d6 2d(3*2) (2)d8 d(d4)")
+	assert.NoError(t, err)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.DynamicDiceTerm{
+			Count: ast.DiceTerm{Count: 1, Faces: 4},
+			Faces: ast.IntTerm{Value: 6},
+		}},
+		{Name: "", Term: ast.DynamicDiceTerm{
+			Count: ast.IntTerm{Value: 2},
+			Faces: ast.MultiplyTerm{Left: ast.IntTerm{Value: 3}, Right: ast.IntTerm{Value: 2}},
+		}},
+		{Name: "", Term: ast.DiceTerm{Count: 2, Faces: 8}},
+		{Name: "", Term: ast.DynamicDiceTerm{
+			Count: ast.IntTerm{Value: 1},
+			Faces: ast.DiceTerm{Count: 1, Faces: 4},
+		}},
+	}}, ast.WithoutSpans(formula))
+
+	formula, err = parser.Parse("(1d4)d{1,2}")
+	assert.EqualError(t, err, `line 1 column 7: expected "(", got "{"`)
+	assert.Empty(t, formula.Equations)
+}
+
+func TestGroups(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse("{2d6+1, 1d12}kh1 4d6dl1KH2 {1d20+5, d20}>=15 (d4)d6kl")
+	assert.NoError(t, err)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.KeepTerm{
+			Pool: ast.GroupTerm{Members: []ast.Term{
+				ast.AddTerm{Left: ast.DiceTerm{Count: 2, Faces: 6}, Right: ast.IntTerm{Value: 1}},
+				ast.DiceTerm{Count: 1, Faces: 12},
+			}},
+			Selection: ast.KeepHighest,
+			Count:     1,
+		}},
+		{Name: "", Term: ast.KeepTerm{
+			Pool: ast.KeepTerm{
+				Pool:      ast.DiceTerm{Count: 4, Faces: 6},
+				Selection: ast.DropLowest,
+				Count:     1,
+			},
+			Selection: ast.KeepHighest,
+			Count:     2,
+		}},
+		{Name: "", Term: ast.SuccessTerm{
+			Pool: ast.GroupTerm{Members: []ast.Term{
+				ast.AddTerm{Left: ast.DiceTerm{Count: 1, Faces: 20}, Right: ast.IntTerm{Value: 5}},
+				ast.DiceTerm{Count: 1, Faces: 20},
+			}},
+			Comparison: ast.GreaterEqual,
+			Target:     15,
+		}},
+		{Name: "", Term: ast.KeepTerm{
+			Pool: ast.DynamicDiceTerm{
+				Count: ast.DiceTerm{Count: 1, Faces: 4},
+				Faces: ast.IntTerm{Value: 6},
+			},
+			Selection: ast.KeepLowest,
+			Count:     1,
+		}},
+	}}, ast.WithoutSpans(formula))
+
+	formula, err = parser.Parse("{1d6 1d8}")
+	assert.EqualError(t, err, `line 1 column 6: expected "," or "}", got "1"`)
+	assert.Empty(t, formula.Equations)
+}
+
+func TestCriticals(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse("d20cs>=19cf1 2d20kh1CS20")
+	assert.NoError(t, err)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.CriticalTerm{
+			Pool: ast.CriticalTerm{
+				Pool:       ast.DiceTerm{Count: 1, Faces: 20},
+				Critical:   ast.CriticalSuccess,
+				Comparison: ast.GreaterEqual,
+				Target:     19,
+			},
+			Critical:   ast.CriticalFailure,
+			Comparison: ast.Equal,
+			Target:     1,
+		}},
+		{Name: "", Term: ast.CriticalTerm{
+			Pool: ast.KeepTerm{
+				Pool:      ast.DiceTerm{Count: 2, Faces: 20},
+				Selection: ast.KeepHighest,
+				Count:     1,
+			},
+			Critical:   ast.CriticalSuccess,
+			Comparison: ast.Equal,
+			Target:     20,
+		}},
+	}}, ast.WithoutSpans(formula))
+
+	formula, err = parser.Parse("d20cs + 1")
+	assert.EqualError(t, err, `line 1 column 7: expected comparison, got "+"`)
+	assert.Empty(t, formula.Equations)
+}
+
+func TestLabels(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse("damage = 2d6 [slashing] + (1d8 + 1)[ fire ] # Flame tongue\n3")
+	assert.NoError(t, err)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{
+		{Name: "damage", Term: ast.AddTerm{
+			Left: ast.LabelTerm{Term: ast.DiceTerm{Count: 2, Faces: 6}, Label: "slashing"},
+			Right: ast.LabelTerm{
+				Term:  ast.AddTerm{Left: ast.DiceTerm{Count: 1, Faces: 8}, Right: ast.IntTerm{Value: 1}},
+				Label: "fire",
+			},
+		}},
+		{Name: "", Term: ast.IntTerm{Value: 3}},
+	}}, ast.WithoutSpans(formula))
+}
+
+func TestQuotedNames(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse(`"Attack #2" = 1d20, "Lvl 5" Fireball = 8d6, "" = 1`)
+	assert.NoError(t, err)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{
+		{Name: "Attack #2", Term: ast.DiceTerm{Count: 1, Faces: 20}},
+		{Name: "Lvl 5 Fireball", Term: ast.DiceTerm{Count: 8, Faces: 6}},
+		{Name: "", Term: ast.IntTerm{Value: 1}},
+	}}, ast.WithoutSpans(formula))
+
+	formula, err = parser.Parse(`"Attack #2 = 1d20`)
+	assert.EqualError(t, err, `line 1 column 1: expected integer or dice term or "(", got "\"Attack #2 = 1d20"`)
+	assert.Empty(t, formula.Equations)
+}
+
+func TestUnicode(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse("２ｄ６ × 3 − 1")
+	assert.NoError(t, err)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.MultiplyTerm{
+			Left: ast.DiceTerm{Count: 2, Faces: 6},
+			Right: ast.SubtractTerm{
+				Left:  ast.IntTerm{Value: 3},
+				Right: ast.IntTerm{Value: 1},
+			},
+		}},
+	}}, ast.WithoutSpans(formula))
+
+	formula, err = parser.Parse("2d6 ××")
+	assert.EqualError(t, err, `line 1 column 6: expected integer or dice term or "(", got "×"`)
+	assert.Empty(t, formula.Equations)
+}
+
+func TestRecovery(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse(`
+		1d6 + !, if(d20 >= !, 1, 2), 2d6
+		(1d8 +
+		one two = 3 ! four = 4 +, 5
+	`)
+	assert.Equal(t, parser.SyntaxErrors{
+		{Expected: []string{"integer", "dice term", `"("`}, Received: token.New(9, 2, 9, token.Unrecognized, "!"), Suggestion: ""},
+		{Expected: []string{"integer", "dice term", `"("`}, Received: token.New(22, 2, 22, token.Unrecognized, "!"), Suggestion: ""},
+		{Expected: []string{"integer", "dice term", `"("`}, Received: token.New(47, 4, 3, token.Word, "one"), Suggestion: ""},
+		{Expected: []string{"integer", "dice term", `"("`}, Received: token.New(59, 4, 15, token.Unrecognized, "!"), Suggestion: ""},
+		{Expected: []string{"integer", "dice term", `"("`}, Received: token.New(71, 4, 27, token.Comma, ","), Suggestion: ""},
+	}, err)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.DiceTerm{Count: 2, Faces: 6}},
+		{Name: "one two", Term: ast.IntTerm{Value: 3}},
+		{Name: "", Term: ast.IntTerm{Value: 5}},
+	}}, ast.WithoutSpans(formula))
+}
+
+func TestOrdinals(t *testing.T) {
+	t.Parallel()
+
+	// Equations keep the ordinals they were written with after errors.
+	formula, err := parser.Parse("1d20 +, 2d6, hit = , 1d8\n3d4")
+	assert.Error(t, err)
+	assert.Len(t, formula.Equations, 3)
+
+	for index, ordinal := range []int{2, 4, 5} {
+		assert.Equal(t, ordinal, formula.Equations[index].Ordinal, "equation %v should have the expected ordinal", index)
+	}
+}
+
+func TestLargeIntegers(t *testing.T) {
+	t.Parallel()
+
+	huge, _ := new(big.Int).SetString("-99999999999999999999", 10)
+
+	formula, err := parser.Parse("-99999999999999999999, -9223372036854775808, 2d6kh99999999999999999999")
+	assert.NoError(t, err)
+	assert.Equal(t, &ast.Formula{Equations: []ast.Equation{
+		{Name: "", Term: ast.BigIntTerm{Value: huge}},
+		{Name: "", Term: ast.IntTerm{Value: math.MinInt}},
+		{Name: "", Term: ast.KeepTerm{Pool: ast.DiceTerm{Count: 2, Faces: 6}, Selection: ast.KeepHighest, Count: math.MaxInt}},
+	}}, ast.WithoutSpans(formula))
+
+	// Dice counts, faces and targets must fit in an int.
+	_, err = parser.Parse("99999999999999999999d6, d99999999999999999999, {1}>=99999999999999999999, d{1:99999999999999999999}")
+	assert.EqualError(t, err, strings.Join([]string{
+		`line 1 column 1: expected smaller integer, got "99999999999999999999"`,
+		`line 1 column 25: expected smaller integer, got "d99999999999999999999"`,
+		`line 1 column 53: expected smaller integer, got "99999999999999999999"`,
+		`line 1 column 79: expected smaller integer, got "99999999999999999999"`,
+	}, "\n"))
+}
+
+func TestParseContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	formula, err := parser.ParseContext(ctx, "1d20 + 5, 2d6")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, formula.Equations)
+}
+
+func TestSuggestions(t *testing.T) {
+	t.Parallel()
+
+	_, err := parser.Parse("2x6 + 1, d 20, 2D 8, iff(1, 2, 3), when(1, 2, 3)")
+	assert.EqualError(t, err, strings.Join([]string{
+		`line 1 column 2: expected dice term, got "x6"; did you mean "2d6"?`,
+		`line 1 column 10: expected integer or dice term or "(", got "d"; did you mean "d20"?`,
+		`line 1 column 17: expected dice term, got "D"; did you mean "2D8"?`,
+		`line 1 column 22: expected "if", got "iff"; did you mean "if"?`,
+		`line 1 column 36: expected "if", got "when"`,
+	}, "\n"))
+}
+
+func TestAdvantage(t *testing.T) {
+	t.Parallel()
+
+	formula, err := parser.Parse("adv d20 + 5, hit = DIS 1d20, elven accuracy (1d20 + 2) + 1d6, adv = 1d20")
+	assert.NoError(t, err)
+	assert.Equal(t, "2d20kh1 + 5, hit = 2d20kl1, 3d20kh1 + 2 + 1d6, adv = 1d20", formula.String())
+
+	_, err = parser.Parse("adv 2d6, dis")
+	assert.EqualError(t, err, strings.Join([]string{
+		`line 1 column 5: expected d20, got "2"`,
+		`line 1 column 12: expected integer or dice term or "(", got end of input`,
+	}, "\n"))
+}
+
+func TestDiagnostic(t *testing.T) {
+	t.Parallel()
+
+	input := "1d20 +\n\t(2x6 + 3"
+
+	var syntaxErrors parser.SyntaxErrors
+
+	_, err := parser.Parse(input)
+	assert.ErrorAs(t, err, &syntaxErrors)
+	assert.Len(t, syntaxErrors, 1)
+	assert.Equal(t, "\t(2x6 + 3\n\t  ^^", syntaxErrors[0].Diagnostic(input))
+
+	_, err = parser.Parse("(5d8")
+	assert.ErrorAs(t, err, &syntaxErrors)
+	assert.Len(t, syntaxErrors, 1)
+	assert.Equal(t, "(5d8\n    ^", syntaxErrors[0].Diagnostic("(5d8"))
+}
+
+func TestSpans(t *testing.T) {
+	t.Parallel()
+
+	input := "attack = 1d20 + (1d4)d6kh1 [fire]\n\t/ 0, 2 × {d4, ｄ６}>=3"
+
+	formula, err := parser.Parse(input)
+	assert.NoError(t, err)
+
+	source := func(span token.Span) string {
+		return input[span.Start.Offset:span.End.Offset]
+	}
+
+	attack := formula.Equations[0]
+	assert.Equal(t, "attack = 1d20 + (1d4)d6kh1 [fire]\n\t/ 0", source(attack.Span))
+	assert.Equal(t, token.Position{Offset: 38, Line: 2, Column: 5}, attack.Span.End)
+
+	divTerm, _ := attack.Term.(ast.DivideTerm)
+	assert.Equal(t, "1d20 + (1d4)d6kh1 [fire]\n\t/ 0", source(divTerm.Span))
+	assert.Equal(t, "0", source(divTerm.Right.Source()))
+
+	addTerm, _ := divTerm.Left.(ast.AddTerm)
+	assert.Equal(t, "1d20", source(addTerm.Left.Source()))
+	assert.Equal(t, "(1d4)d6kh1 [fire]", source(addTerm.Right.Source()))
+
+	labelTerm, _ := addTerm.Right.(ast.LabelTerm)
+	keepTerm, _ := labelTerm.Term.(ast.KeepTerm)
+	diceTerm, _ := keepTerm.Pool.(ast.DynamicDiceTerm)
+	assert.Equal(t, "(1d4)d6kh1", source(keepTerm.Span))
+	assert.Equal(t, "(1d4)d6", source(diceTerm.Span))
+	assert.Equal(t, "1d4", source(diceTerm.Count.Source()))
+	assert.Equal(t, "6", source(diceTerm.Faces.Source()))
+
+	mulTerm, _ := formula.Equations[1].Term.(ast.MultiplyTerm)
+	successTerm, _ := mulTerm.Right.(ast.SuccessTerm)
+	groupTerm, _ := successTerm.Pool.(ast.GroupTerm)
+	assert.Equal(t, "2 × {d4, ｄ６}>=3", source(mulTerm.Span))
+	assert.Equal(t, "{d4, ｄ６}", source(groupTerm.Span))
+	assert.Equal(t, "ｄ６", source(groupTerm.Members[1].Source()))
+
+	// Errors raised while evaluating point at the term that raised them.
+	results := ast.NewEvaluator().EvaluateFormula(formula)
+
+	var evaluationError *ast.EvaluationError
+
+	assert.ErrorIs(t, results[0].Err, ast.ErrDivisionByZero)
+	assert.ErrorAs(t, results[0].Err, &evaluationError)
+	assert.EqualError(t, evaluationError, "line 1 column 10: division by zero")
+	assert.Equal(t, divTerm.Span, evaluationError.Span)
+	assert.Equal(t, "attack = 1d20 + (1d4)d6kh1 [fire]\n         ^^^^^^^^^^^^^^^^^^^^^^^^", evaluationError.Span.Diagnostic(input))
 }
@@ -0,0 +1,98 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+// Names that may be called like "if(...)".
+var functions = []string{"if"}
+
+// Matches "x6" as in "2x6", a common way of writing 2d6.
+var regexpTimesDice = regexp.MustCompile(`\A[Xx]\d+\z`)
+
+// Suggest a dice term when the current integer is directly followed by "x6" as
+// in "2x6" or by "d 20" as in "2d 20".
+func (parser *parser) suggestDice() string {
+	count := parser.currentToken
+	next := parser.nextToken
+
+	if !adjacent(count, next) {
+		return ""
+	}
+
+	if next.Kind == token.Word && regexpTimesDice.MatchString(next.String) {
+		return count.String + "d" + next.String[1:]
+	}
+
+	if parser.isSpacedDice(1) {
+		return count.String + next.String + parser.peek(2).String //nolint:gomnd
+	}
+
+	return ""
+}
+
+// Report whether the token at offset from the current one is a lone "d"
+// followed by an integer, as in "d 20".
+func (parser *parser) isSpacedDice(offset int) bool {
+	word := parser.peek(offset)
+
+	return word.Kind == token.Word && strings.EqualFold(word.String, "d") && parser.peek(offset+1).Kind == token.Int
+}
+
+// Report whether right starts immediately after left ends.
+func adjacent(left, right token.Token) bool {
+	return left.Line == right.Line && left.Column+utf8.RuneCountInString(left.String) == right.Column
+}
+
+// Return the candidate closest to word if it is close enough to be a typo, or
+// an empty string otherwise.
+func closestWord(word string, candidates []string) string {
+	closest := ""
+	closestDistance := 3 //nolint:gomnd
+
+	for _, candidate := range candidates {
+		distance := editDistance(strings.ToLower(word), candidate)
+		if distance < closestDistance && distance < utf8.RuneCountInString(word) {
+			closest = candidate
+			closestDistance = distance
+		}
+	}
+
+	return closest
+}
+
+// Count the insertions, deletions and substitutions needed to turn left into
+// right.
+func editDistance(left, right string) int {
+	leftRunes := []rune(left)
+	rightRunes := []rune(right)
+
+	// Only keep the previous row of the usual distance matrix.
+	previous := make([]int, len(rightRunes)+1)
+	current := make([]int, len(rightRunes)+1)
+
+	for index := range previous {
+		previous[index] = index
+	}
+
+	for leftIndex, leftRune := range leftRunes {
+		current[0] = leftIndex + 1
+
+		for rightIndex, rightRune := range rightRunes {
+			substitution := previous[rightIndex]
+			if leftRune != rightRune {
+				substitution++
+			}
+
+			current[rightIndex+1] = min(previous[rightIndex+1]+1, current[rightIndex]+1, substitution)
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(rightRunes)]
+}
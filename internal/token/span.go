@@ -0,0 +1,65 @@
+package token
+
+import "strings"
+
+// Position is a location in the input. Offset counts bytes while Line and
+// Column count runes the same way the lexer does.
+type Position struct {
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Span is the part of the input from Start up to, but not including, End.
+type Span struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// Diagnostic renders the first line of input covered by the span with carets
+// under it, such as:
+//
+//	2x6 + 1
+//	 ^^
+func (span Span) Diagnostic(input string) string {
+	line := []rune{}
+	lineNumber := 1
+
+	for _, currentRune := range input {
+		if IsLineSeparator(currentRune) {
+			lineNumber++
+
+			continue
+		}
+
+		if lineNumber == span.Start.Line {
+			line = append(line, currentRune)
+		}
+	}
+
+	width := span.End.Column - span.Start.Column
+	if span.End.Line != span.Start.Line {
+		width = len(line)
+	}
+
+	start := min(max(span.Start.Column-1, 0), len(line))
+	width = max(min(width, len(line)-start), 1)
+
+	var output strings.Builder
+
+	output.WriteString(string(line))
+	output.WriteByte('\n')
+
+	// Copy tabs so that the carets line up however wide tabs are.
+	for _, currentRune := range line[:start] {
+		if currentRune == '\t' {
+			output.WriteRune('\t')
+		} else {
+			output.WriteRune(' ')
+		}
+	}
+
+	output.WriteString(strings.Repeat("^", width))
+
+	return output.String()
+}
@@ -1,6 +1,10 @@
 package token
 
-import "fmt"
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
 
 type Kind int
 
@@ -8,9 +12,19 @@ const (
 	Unrecognized Kind = iota
 	RuneError
 	EOF
+	Comma
 	Equal
+	EqualEqual
+	NotEqual
+	Less
+	LessEqual
+	Greater
+	GreaterEqual
 	LeftParentheses
 	RightParentheses
+	LeftBrace
+	RightBrace
+	Colon
 	Exponentiate
 	Multiply
 	Divide
@@ -19,32 +33,103 @@ const (
 	D
 	Int
 	Word
+	Label
+	String
+	// Attribute is a reference to a character sheet in another tool's dice
+	// syntax, such as @{strength}. The lexer never returns it.
+	Attribute
 )
 
 type Token struct {
+	Offset int
 	Line   int
 	Column int
 	Kind   Kind
 	String string
 }
 
-func New(line, column int, kind Kind, str string) Token {
-	return Token{Line: line, Column: column, Kind: kind, String: str}
+func New(offset, line, column int, kind Kind, str string) Token {
+	return Token{Offset: offset, Line: line, Column: column, Kind: kind, String: str}
+}
+
+func (token Token) Start() Position {
+	return Position{Offset: token.Offset, Line: token.Line, Column: token.Column}
+}
+
+// End returns the position just past the last character of the token.
+func (token Token) End() Position {
+	line := token.Line
+	column := token.Column - 1
+
+	// Labels may span several lines.
+	for _, currentRune := range token.String {
+		if IsLineSeparator(currentRune) {
+			line++
+			column = 0
+		} else {
+			column++
+		}
+	}
+
+	return Position{Offset: token.Offset + len(token.String), Line: line, Column: column + 1}
+}
+
+func (token Token) Span() Span {
+	return Span{Start: token.Start(), End: token.End()}
 }
 
-func (token Token) Int() int {
-	value := 0
+// IsLineSeparator reports whether the lexer counts currentRune as the end of a
+// line.
+func IsLineSeparator(currentRune rune) bool {
+	const (
+		FileSeparator           = rune(0x1C)
+		GroupSeparator          = rune(0x1D)
+		InformationSeparatorTwo = rune(0x1E)
+		NextLine                = rune(0x85)
+		LineSeparator           = rune(0x2028)
+		ParagraphSeparator      = rune(0x2029)
+	)
+
+	switch currentRune {
+	case '\n', '\r', FileSeparator, GroupSeparator, InformationSeparatorTwo, NextLine, LineSeparator, ParagraphSeparator:
+		return true
+	default:
+		return false
+	}
+}
+
+// BigInt returns the value of an integer token, however many digits it has.
+func (token Token) BigInt() *big.Int {
+	value := new(big.Int)
+	digit := new(big.Int)
+
+	for _, currentRune := range token.String {
+		// Full-width digits count the same as ASCII ones.
+		if '０' <= currentRune && currentRune <= '９' {
+			currentRune = currentRune - '０' + '0'
+		}
 
-	// We can iterate on byte instead of rune because integers are currently only ASCII.
-	for _, currentByte := range []byte(token.String) {
-		if '0' <= currentByte && currentByte <= '9' {
-			value = value*10 + (int(currentByte) - '0') //nolint:gomnd
+		if '0' <= currentRune && currentRune <= '9' {
+			value.Mul(value, big.NewInt(10)) //nolint:gomnd
+			value.Add(value, digit.SetInt64(int64(currentRune-'0')))
 		}
 	}
 
 	return value
 }
 
+// Int returns the value of an integer token and whether it fits in an int.
+func (token Token) Int() (int, bool) {
+	value := token.BigInt()
+
+	return int(value.Int64()), FitsInt(value)
+}
+
+// FitsInt reports whether value can be converted to an int without wrapping.
+func FitsInt(value *big.Int) bool {
+	return value.IsInt64() && int64(int(value.Int64())) == value.Int64()
+}
+
 func (token Token) Quote() string {
 	switch token.Kind { //nolint:exhaustive
 	case RuneError:
@@ -55,3 +140,31 @@ func (token Token) Quote() string {
 		return fmt.Sprintf("%q", token.String)
 	}
 }
+
+// LabelText returns the text of a label token without its brackets or
+// surrounding whitespace.
+func (token Token) LabelText() string {
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(token.String, "["), "]"))
+}
+
+// Unquote returns the text of a string token without its quotes and with
+// escape sequences replaced by the character they escape.
+func (token Token) Unquote() string {
+	var output strings.Builder
+
+	escaped := false
+
+	for _, currentRune := range strings.TrimSuffix(strings.TrimPrefix(token.String, `"`), `"`) {
+		if currentRune == '\\' && !escaped {
+			escaped = true
+
+			continue
+		}
+
+		escaped = false
+
+		output.WriteRune(currentRune)
+	}
+
+	return output.String()
+}
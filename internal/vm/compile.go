@@ -0,0 +1,216 @@
+// Package vm compiles terms to a compact stack-based bytecode that can be
+// evaluated many times over without allocating, such as for simulations.
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+var ErrUnsupportedTerm = errors.New("unsupported term")
+
+type Op uint8
+
+const (
+	// Push A onto the stack.
+	OpPush Op = iota
+	OpAdd
+	OpSubtract
+	OpMultiply
+	OpDivide
+	// Compare the top two values with ast.Comparison(A).
+	OpCompare
+	// Jump to A.
+	OpJump
+	// Pop a value and jump to A if it is zero.
+	OpJumpIfZero
+	// Push the start of a new pool of dice.
+	OpBeginPool
+	// Pop the faces and count and add that many dice to the pool.
+	OpRoll
+	// Pop the count and add that many dice with the faces of custom die A
+	// to the pool.
+	OpRollCustom
+	// Pop a value and add it to the pool as a member of a group.
+	OpMember
+	// Drop dice from the pool with ast.Selection(A) and a count of B.
+	OpKeep
+	// Pop the start of the pool and push the sum of its dice.
+	OpSum
+	// Pop the start of the pool and push the number of its dice that
+	// satisfy ast.Comparison(A) with B.
+	OpCountSuccesses
+)
+
+type Instruction struct {
+	Op   Op
+	A, B int
+}
+
+type customDie struct {
+	faces       []ast.Face
+	totalWeight int
+}
+
+// Program is a compiled term. Labels and critical markers do not change totals
+// and are left out.
+type Program struct {
+	Code []Instruction
+	// Spans holds the span of the term each instruction was compiled from
+	// so that errors can point at it.
+	Spans      []token.Span
+	customDice []customDie
+}
+
+// Compile compiles each equation of formula to its own program.
+func Compile(formula *ast.Formula) ([]*Program, error) {
+	programs := make([]*Program, 0, len(formula.Equations))
+
+	for _, equation := range formula.Equations {
+		program, err := CompileTerm(equation.Term)
+		if err != nil {
+			return nil, err
+		}
+
+		programs = append(programs, program)
+	}
+
+	return programs, nil
+}
+
+func CompileTerm(term ast.Term) (*Program, error) {
+	program := &Program{Code: nil, Spans: nil, customDice: nil}
+
+	if err := program.compile(term); err != nil {
+		return nil, err
+	}
+
+	return program, nil
+}
+
+func (program *Program) emit(op Op, a, b int, span token.Span) int {
+	program.Code = append(program.Code, Instruction{Op: op, A: a, B: b})
+	program.Spans = append(program.Spans, span)
+
+	return len(program.Code) - 1
+}
+
+//nolint:cyclop,funlen
+func (program *Program) compile(term ast.Term) error {
+	switch term := term.(type) {
+	case ast.IntTerm:
+		program.emit(OpPush, term.Value, 0, term.Span)
+	case ast.AttributeTerm:
+		program.emit(OpPush, 0, 0, term.Span)
+	case ast.CompareTerm:
+		return program.compileBinary(OpCompare, int(term.Comparison), term.Left, term.Right, term.Span)
+	case ast.ConditionalTerm:
+		if err := program.compile(term.Condition); err != nil {
+			return err
+		}
+
+		jumpToElse := program.emit(OpJumpIfZero, 0, 0, term.Span)
+
+		if err := program.compile(term.Then); err != nil {
+			return err
+		}
+
+		jumpToEnd := program.emit(OpJump, 0, 0, term.Span)
+		program.Code[jumpToElse].A = len(program.Code)
+
+		if err := program.compile(term.Else); err != nil {
+			return err
+		}
+
+		program.Code[jumpToEnd].A = len(program.Code)
+	case ast.MultiplyTerm:
+		return program.compileBinary(OpMultiply, 0, term.Left, term.Right, term.Span)
+	case ast.DivideTerm:
+		return program.compileBinary(OpDivide, 0, term.Left, term.Right, term.Span)
+	case ast.AddTerm:
+		return program.compileBinary(OpAdd, 0, term.Left, term.Right, term.Span)
+	case ast.SubtractTerm:
+		return program.compileBinary(OpSubtract, 0, term.Left, term.Right, term.Span)
+	case ast.LabelTerm:
+		return program.compile(term.Term)
+	case ast.SuccessTerm:
+		program.emit(OpBeginPool, 0, 0, term.Span)
+
+		if err := program.compilePool(term.Pool); err != nil {
+			return err
+		}
+
+		program.emit(OpCountSuccesses, int(term.Comparison), term.Target, term.Span)
+	case ast.Pool:
+		program.emit(OpBeginPool, 0, 0, term.Source())
+
+		if err := program.compilePool(term); err != nil {
+			return err
+		}
+
+		program.emit(OpSum, 0, 0, term.Source())
+	default:
+		return fmt.Errorf("%w: %T", ErrUnsupportedTerm, term)
+	}
+
+	return nil
+}
+
+func (program *Program) compileBinary(op Op, a int, left, right ast.Term, span token.Span) error {
+	if err := program.compile(left); err != nil {
+		return err
+	}
+
+	if err := program.compile(right); err != nil {
+		return err
+	}
+
+	program.emit(op, a, 0, span)
+
+	return nil
+}
+
+// Compile the instructions that add the dice of pool to the current pool.
+func (program *Program) compilePool(pool ast.Pool) error {
+	switch pool := pool.(type) {
+	case ast.DiceTerm:
+		program.emit(OpPush, pool.Count, 0, pool.Span)
+		program.emit(OpPush, pool.Faces, 0, pool.Span)
+		program.emit(OpRoll, 0, 0, pool.Span)
+	case ast.DynamicDiceTerm:
+		return program.compileBinary(OpRoll, 0, pool.Count, pool.Faces, pool.Span)
+	case ast.CustomDiceTerm:
+		totalWeight := 0
+
+		for _, face := range pool.Faces {
+			totalWeight += face.Weight
+		}
+
+		program.customDice = append(program.customDice, customDie{faces: pool.Faces, totalWeight: totalWeight})
+		program.emit(OpPush, pool.Count, 0, pool.Span)
+		program.emit(OpRollCustom, len(program.customDice)-1, 0, pool.Span)
+	case ast.GroupTerm:
+		for _, member := range pool.Members {
+			if err := program.compile(member); err != nil {
+				return err
+			}
+
+			program.emit(OpMember, 0, 0, pool.Span)
+		}
+	case ast.KeepTerm:
+		if err := program.compilePool(pool.Pool); err != nil {
+			return err
+		}
+
+		program.emit(OpKeep, int(pool.Selection), pool.Count, pool.Span)
+	case ast.CriticalTerm:
+		return program.compilePool(pool.Pool)
+	default:
+		return fmt.Errorf("%w: %T", ErrUnsupportedTerm, pool)
+	}
+
+	return nil
+}
@@ -0,0 +1,297 @@
+package vm
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/token"
+)
+
+// Machine runs programs. Its stacks are kept between runs so that running a
+// program again does not allocate.
+type Machine struct {
+	Limits     ast.Limits
+	stack      []int
+	pool       []poolValue
+	counts     []int
+	diceRolled int
+}
+
+// A value in a pool and how many dice or members have it. Sampled pools add
+// each value once with the number of dice that rolled it.
+type poolValue struct {
+	value, count int
+}
+
+func NewMachine() *Machine {
+	return &Machine{Limits: ast.DefaultLimits, stack: nil, pool: nil, counts: nil, diceRolled: 0}
+}
+
+// Run a program and return its total. Limits apply to each run separately.
+// Unlike the evaluator, arithmetic is not checked for overflow, so integers too
+// large for an int fail to compile instead.
+func (machine *Machine) Run(program *Program) (int, error) {
+	return machine.RunContext(context.Background(), program)
+}
+
+// RunContext is like Run, but stops with the error of ctx once it is done. The
+// context is checked before rolling each pool and every contextInterval dice,
+// so that long simulations can be cancelled between or during runs.
+//
+//nolint:cyclop,funlen,gocognit
+func (machine *Machine) RunContext(ctx context.Context, program *Program) (int, error) {
+	machine.stack = machine.stack[:0]
+	machine.pool = machine.pool[:0]
+	machine.diceRolled = 0
+
+	for counter := 0; counter < len(program.Code); counter++ {
+		instruction := program.Code[counter]
+
+		switch instruction.Op {
+		case OpPush:
+			machine.push(instruction.A)
+		case OpAdd:
+			right := machine.pop()
+			machine.stack[len(machine.stack)-1] += right
+		case OpSubtract:
+			right := machine.pop()
+			machine.stack[len(machine.stack)-1] -= right
+		case OpMultiply:
+			right := machine.pop()
+			machine.stack[len(machine.stack)-1] *= right
+		case OpDivide:
+			right := machine.pop()
+			if right == 0 {
+				return 0, wrapSpan(ast.ErrDivisionByZero, program.Spans[counter])
+			}
+
+			machine.stack[len(machine.stack)-1] /= right
+		case OpCompare:
+			right := machine.pop()
+			left := machine.pop()
+
+			if ast.Comparison(instruction.A).Compare(left, right) {
+				machine.push(1)
+			} else {
+				machine.push(0)
+			}
+		case OpJump:
+			counter = instruction.A - 1
+		case OpJumpIfZero:
+			if machine.pop() == 0 {
+				counter = instruction.A - 1
+			}
+		case OpBeginPool:
+			machine.push(len(machine.pool))
+		case OpRoll:
+			faces := machine.pop()
+			count := machine.pop()
+
+			if err := machine.checkDice(ctx, count, faces); err != nil {
+				return 0, wrapSpan(err, program.Spans[counter])
+			}
+
+			if ast.ShouldSample(count, faces) {
+				machine.sample(count, faces)
+
+				continue
+			}
+
+			for index := 0; index < count; index++ {
+				if err := interrupted(ctx, index); err != nil {
+					return 0, wrapSpan(err, program.Spans[counter])
+				}
+
+				machine.pool = append(machine.pool, poolValue{value: rand.Intn(faces) + 1, count: 1}) //nolint:gosec
+			}
+		case OpRollCustom:
+			die := program.customDice[instruction.A]
+			count := machine.pop()
+
+			if err := machine.checkDice(ctx, count, len(die.faces)); err != nil {
+				return 0, wrapSpan(err, program.Spans[counter])
+			}
+
+			if ast.ShouldSample(count, len(die.faces)) {
+				machine.sampleCustom(count, die.faces)
+
+				continue
+			}
+
+			for index := 0; index < count; index++ {
+				if err := interrupted(ctx, index); err != nil {
+					return 0, wrapSpan(err, program.Spans[counter])
+				}
+
+				machine.pool = append(machine.pool, poolValue{value: die.roll(), count: 1})
+			}
+		case OpMember:
+			machine.pool = append(machine.pool, poolValue{value: machine.pop(), count: 1})
+		case OpKeep:
+			machine.keep(machine.stack[len(machine.stack)-1], ast.Selection(instruction.A), instruction.B)
+		case OpSum:
+			start := machine.pop()
+			total := 0
+
+			for _, value := range machine.pool[start:] {
+				total += value.value * value.count
+			}
+
+			machine.pool = machine.pool[:start]
+			machine.push(total)
+		case OpCountSuccesses:
+			start := machine.pop()
+			successes := 0
+
+			for _, value := range machine.pool[start:] {
+				if ast.Comparison(instruction.A).Compare(value.value, instruction.B) {
+					successes += value.count
+				}
+			}
+
+			machine.pool = machine.pool[:start]
+			machine.push(successes)
+		default:
+			return 0, fmt.Errorf("%w: unknown instruction %v", ErrUnsupportedTerm, instruction.Op)
+		}
+	}
+
+	return machine.pop(), nil
+}
+
+func (machine *Machine) push(value int) {
+	machine.stack = append(machine.stack, value)
+}
+
+func (machine *Machine) pop() int {
+	value := machine.stack[len(machine.stack)-1]
+	machine.stack = machine.stack[:len(machine.stack)-1]
+
+	return value
+}
+
+func (machine *Machine) checkDice(ctx context.Context, count, faces int) error {
+	if err := ctx.Err(); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	cost, err := machine.Limits.CheckDice(count, faces, machine.diceRolled)
+	if err != nil {
+		return err
+	}
+
+	machine.diceRolled += cost
+
+	return nil
+}
+
+// How many dice to roll between checks of the context.
+const contextInterval = 1024
+
+// Report the error of ctx every contextInterval dice.
+func interrupted(ctx context.Context, diceRolled int) error {
+	if diceRolled%contextInterval != contextInterval-1 {
+		return nil
+	}
+
+	return ctx.Err() //nolint:wrapcheck
+}
+
+// Add count dice to the pool by sampling how many land on each face.
+func (machine *Machine) sample(count, faces int) {
+	counts := machine.sampleCounts(faces)
+	ast.SampleFaces(counts, count)
+
+	for index, facesRolled := range counts {
+		if facesRolled > 0 {
+			machine.pool = append(machine.pool, poolValue{value: index + 1, count: facesRolled})
+		}
+	}
+}
+
+// Add count custom dice to the pool by sampling how many land on each face.
+func (machine *Machine) sampleCustom(count int, faces []ast.Face) {
+	counts := machine.sampleCounts(len(faces))
+	ast.SampleWeightedFaces(counts, count, faces)
+
+	for index, facesRolled := range counts {
+		if facesRolled > 0 {
+			machine.pool = append(machine.pool, poolValue{value: faces[index].Value, count: facesRolled})
+		}
+	}
+}
+
+// Return space to count the dice that land on each of the faces.
+func (machine *Machine) sampleCounts(faces int) []int {
+	if cap(machine.counts) < faces {
+		machine.counts = make([]int, faces)
+	}
+
+	return machine.counts[:faces]
+}
+
+// Remove the dice dropped by a selection from the pool starting at start. Only
+// the totals of pools are needed, so dropped dice are removed rather than
+// marked and the order of the rest is not kept.
+func (machine *Machine) keep(start int, selection ast.Selection, count int) {
+	values := machine.pool[start:]
+	size := 0
+
+	for _, value := range values {
+		size += value.count
+	}
+
+	count = min(max(count, 0), size)
+
+	slices.SortFunc(values, func(left, right poolValue) int { return cmp.Compare(left.value, right.value) })
+
+	// Keeping some dice drops the rest from the other end of the pool.
+	dropped := count
+	if selection == ast.KeepHighest || selection == ast.KeepLowest {
+		dropped = size - count
+	}
+
+	if selection == ast.KeepLowest || selection == ast.DropHighest {
+		slices.Reverse(values)
+	}
+
+	// Drop from the front, splitting the last value dropped if needed.
+	kept := values
+
+	for len(kept) > 0 && dropped >= kept[0].count {
+		dropped -= kept[0].count
+		kept = kept[1:]
+	}
+
+	if len(kept) > 0 {
+		kept[0].count -= dropped
+	}
+
+	machine.pool = machine.pool[:start+copy(values, kept)]
+}
+
+func (die customDie) roll() int {
+	pick := rand.Intn(die.totalWeight) //nolint:gosec
+
+	for _, face := range die.faces {
+		if pick < face.Weight {
+			return face.Value
+		}
+
+		pick -= face.Weight
+	}
+
+	return 0
+}
+
+func wrapSpan(err error, span token.Span) error {
+	if span == (token.Span{}) {
+		return err
+	}
+
+	return &ast.EvaluationError{Span: span, Err: err}
+}
@@ -0,0 +1,168 @@
+package vm_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/parser"
+	"meganruggiero.com/dicebot/internal/vm"
+)
+
+func compile(t testing.TB, input string) *vm.Program {
+	t.Helper()
+
+	formula, err := parser.Parse(input)
+	assert.NoError(t, err)
+
+	program, err := vm.CompileTerm(formula.Equations[0].Term)
+	assert.NoError(t, err)
+
+	return program
+}
+
+func TestMachine(t *testing.T) {
+	t.Parallel()
+
+	// Dice with a single face keep the results predictable.
+	inputs := []string{
+		"5 + 2 * 8 / 4 - -1",
+		"3d1 [fire] + d{-2}",
+		"if(2d1 >= 2, 10, 1/0)",
+		"if(2d1 < 2, 1/0, 10)",
+		"{3, 9, 1, 5}kh2 + {3, 9, 1, 5}dl1dh1 + {3, 9, 1, 5}kl1",
+		"{3, 9, 1, 5}dh1>=3 + {2d1, 1d1, 3}kh2cs>=2",
+		"(1d1 + 2)d(2 - 1)kh2",
+		"{{4, 2}kh1, 3}dl1 * {1, 1, 1}==1",
+	}
+
+	machine := vm.NewMachine()
+
+	for _, input := range inputs {
+		formula, err := parser.Parse(input)
+		assert.NoError(t, err, "%q should parse", input)
+
+		expected, err := formula.Equations[0].Term.Evaluate(ast.NewEvaluator())
+		assert.NoError(t, err, "%q should evaluate", input)
+
+		actual, err := machine.Run(compile(t, input))
+		assert.NoError(t, err, "%q should run", input)
+		assert.Equal(t, expected, actual, "%q should match the evaluator", input)
+	}
+
+	for iteration := 0; iteration < 100; iteration++ {
+		value, err := machine.Run(compile(t, "4d6dl1"))
+		assert.NoError(t, err)
+		assert.True(t, 3 <= value && value <= 18, "4d6dl1 should be between 3 and 18, got %v", value)
+	}
+
+	// Huge pools are sampled rather than rolled one die at a time.
+	machine.Limits = ast.Limits{MaxDice: 20, MaxFaces: 6, MaxSampledDice: 100000}
+
+	value, err := machine.Run(compile(t, "100000d6kl10"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, value)
+
+	value, err = machine.Run(compile(t, "1000d2 - 2000"))
+	assert.NoError(t, err)
+	assert.True(t, -1000 < value && value < 0, "1000d2 - 2000 should be between -1000 and 0, got %v", value)
+
+	value, err = machine.Run(compile(t, "100000d6kh10 + 1000d{5, 5:2}kh3"))
+	assert.NoError(t, err)
+	assert.Equal(t, 75, value)
+}
+
+func TestMachineErrors(t *testing.T) {
+	t.Parallel()
+
+	var evaluationError *ast.EvaluationError
+
+	machine := vm.NewMachine()
+	machine.Limits = ast.Limits{MaxDice: 10, MaxFaces: 6}
+
+	_, err := machine.Run(compile(t, "1 + 2 / (1 - 1)"))
+	assert.ErrorIs(t, err, ast.ErrDivisionByZero)
+	assert.ErrorAs(t, err, &evaluationError)
+	assert.EqualError(t, err, "line 1 column 1: division by zero")
+
+	// Limits apply to each run rather than to the machine.
+	for iteration := 0; iteration < 3; iteration++ {
+		_, err = machine.Run(compile(t, "5d6 + 5d6"))
+		assert.NoError(t, err)
+	}
+
+	_, err = machine.Run(compile(t, "5d6 + {2d6, 4d6}"))
+	assert.ErrorIs(t, err, ast.ErrTooManyDice)
+	assert.EqualError(t, err, "line 1 column 13: too many dice: cannot roll more than 10 dice in one formula")
+
+	_, err = machine.Run(compile(t, "(0 - 1)d6"))
+	assert.ErrorIs(t, err, ast.ErrDiceCount)
+
+	_, err = machine.Run(compile(t, "1d7"))
+	assert.ErrorIs(t, err, ast.ErrDiceFaces)
+
+	_, err = vm.CompileTerm(nil)
+	assert.ErrorIs(t, err, vm.ErrUnsupportedTerm)
+}
+
+func TestMachineContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	machine := vm.NewMachine()
+	program := compile(t, "2 + 1d20")
+
+	_, err := machine.RunContext(ctx, program)
+	assert.NoError(t, err)
+
+	cancel()
+
+	_, err = machine.RunContext(ctx, program)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.EqualError(t, err, "line 1 column 5: context canceled")
+}
+
+func TestMachineAllocations(t *testing.T) {
+	program := compile(t, "if(1d20 + 5 >= 15, {2d6 + 3, d{1, 2:3}}kh1 [fire], 1) + 4d6dl1")
+	machine := vm.NewMachine()
+
+	allocations := testing.AllocsPerRun(1000, func() {
+		_, _ = machine.Run(program)
+	})
+	assert.Zero(t, allocations)
+
+	// Sampled pools add each value once rather than each die.
+	program = compile(t, "10000000d6kh3 + 10000000d{-1, 0, 1}")
+
+	allocations = testing.AllocsPerRun(100, func() {
+		_, _ = machine.Run(program)
+	})
+	assert.Zero(t, allocations)
+}
+
+const benchmarkInput = "if(1d20 + 5 >= 15, 2d6 + 3, 0) + {4d6dl1, 4d6dl1}kh1"
+
+func BenchmarkSolve(b *testing.B) {
+	formula, err := parser.Parse(benchmarkInput)
+	assert.NoError(b, err)
+
+	term := formula.Equations[0].Term
+
+	b.ResetTimer()
+
+	for iteration := 0; iteration < b.N; iteration++ {
+		term.Solve()
+	}
+}
+
+func BenchmarkMachine(b *testing.B) {
+	program := compile(b, benchmarkInput)
+	machine := vm.NewMachine()
+
+	b.ResetTimer()
+
+	for iteration := 0; iteration < b.N; iteration++ {
+		_, _ = machine.Run(program)
+	}
+}
@@ -1,33 +1,373 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"math/big"
+	"slices"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/dustin/go-humanize"
+	"meganruggiero.com/dicebot/internal/ast"
+	"meganruggiero.com/dicebot/internal/english"
 	"meganruggiero.com/dicebot/internal/parser"
 )
 
-func roll(input string) string {
-	var output strings.Builder
+// Shown in place of results that were still being rolled when the context was
+// done.
+const rollTimeoutMessage = "took too long to roll"
+
+// How many warnings to show at most.
+const maxWarnings = 3
+
+// Shown in place of results when rolling panicked.
+const rollPanicMessage = "something went wrong while rolling"
+
+// rollOptions are the options of /roll other than the formula.
+type rollOptions struct {
+	// Explain lists the steps taken to roll each equation.
+	explain bool
+	// Mode and rounding decide what the dice roll.
+	mode     ast.Mode
+	rounding ast.Rounding
+	// Dialect is the syntax of the dice roller the formula was written for.
+	dialect parser.Dialect
+	// Advantage and disadvantage roll the first d20 of each equation twice
+	// and keep the higher or lower roll.
+	advantage    bool
+	disadvantage bool
+}
+
+// Roll a formula and format the results as a Discord message. Equations still
+// rolling when ctx is done report that they took too long.
+func roll(ctx context.Context, input string, options rollOptions) string {
+	var output, explanation strings.Builder
+
+	// Equations that parsed cleanly are still rolled after syntax errors.
+	formula, err := parser.ParseDialect(ctx, input, options.dialect)
+	if ctx.Err() != nil {
+		return fmt.Sprintf("**Rolling**: %v\n**Error**: %v", discordEscapeMarkdown(input), rollTimeoutMessage)
+	}
 
-	fmt.Fprintf(&output, "**Rolling**: %v", discordEscapeMarkdown(input))
+	// Read English such as "two d six plus three" that is not notation, and
+	// point out the notation it reads as.
+	original := input
 
-	formula, err := parser.Parse(input)
 	if err != nil {
-		fmt.Fprintf(&output, "\n**Syntax Error**: %v", discordEscapeMarkdown(err.Error()))
+		if translated, isEnglish := english.Translate(input); isEnglish {
+			if translatedFormula, translatedErr := parser.ParseContext(ctx, translated); translatedErr == nil {
+				formula, err, input = translatedFormula, nil, translated
+			}
+		}
+	}
+
+	// Advantage and disadvantage cancel out, as they do at the table.
+	withoutD20 := []ast.Warning{}
+
+	if options.advantage != options.disadvantage {
+		selection, option := ast.KeepHighest, "advantage"
+		if options.disadvantage {
+			selection, option = ast.KeepLowest, "disadvantage"
+		}
+
+		for index, equation := range formula.Equations {
+			term, rollsD20 := ast.KeepD20(equation.Term, 2, selection) //nolint:gomnd
+			if !rollsD20 {
+				withoutD20 = append(withoutD20, ast.Warning{
+					Span:    equation.Span,
+					Message: fmt.Sprintf("%v has no d20 to roll with %v", equation.Term, option),
+				})
+			}
+
+			formula.Equations[index].Term = term
+		}
+	}
+
+	// Lint what was typed rather than what it optimizes to.
+	warnings := append(ast.Lint(formula), withoutD20...)
+	slices.SortStableFunc(warnings, func(left, right ast.Warning) int {
+		return cmp.Compare(left.Span.Start.Offset, right.Span.Start.Offset)
+	})
+	formula = ast.OptimizeMode(formula, options.mode)
+
+	// Echo what was understood so that users learn the notation, unless the
+	// input has errors that refer to it.
+	if err == nil {
+		fmt.Fprintf(&output, "**Rolling**: %v", discordEscapeMarkdown(formula.String()))
+	} else {
+		fmt.Fprintf(&output, "**Rolling**: %v", discordEscapeMarkdown(input))
+	}
+
+	if input != original {
+		fmt.Fprintf(&output, "\n**Translated from**: %v", discordEscapeMarkdown(original))
+	}
 
-		return output.String()
+	switch options.mode {
+	case ast.Random:
+	case ast.Average:
+		fmt.Fprintf(&output, "\n**Mode**: %v, %v", options.mode, options.rounding)
+	default:
+		fmt.Fprintf(&output, "\n**Mode**: %v", options.mode)
 	}
 
-	for index, equation := range formula.Equations {
-		name := equation.Name
+	var syntaxErrors parser.SyntaxErrors
+	if errors.As(err, &syntaxErrors) {
+		for _, syntaxError := range syntaxErrors {
+			fmt.Fprintf(&output, "\n**Syntax Error**: %v\n%v",
+				discordEscapeMarkdown(syntaxError.Error()),
+				discordCodeBlock(syntaxError.Diagnostic(input)))
+		}
+	}
+
+	// Each warning repeats the input, so only the first few that fit in the
+	// message are shown.
+	shownWarnings := 0
+
+	for _, warning := range warnings {
+		text := fmt.Sprintf("\n**Warning**: %v\n%v",
+			discordEscapeMarkdown(warning.String()),
+			discordCodeBlock(warning.Span.Diagnostic(input)))
+		if shownWarnings == maxWarnings ||
+			utf8.RuneCountInString(output.String())+utf8.RuneCountInString(text) > discordMessageLimit {
+			break
+		}
+
+		output.WriteString(text)
+
+		shownWarnings++
+	}
+
+	if shownWarnings < len(warnings) {
+		fmt.Fprintf(&output, "\n… %v more warnings", len(warnings)-shownWarnings)
+	}
+
+	evaluator := ast.NewEvaluatorContext(ctx)
+	evaluator.Mode, evaluator.Rounding = options.mode, options.rounding
+	evaluator.Trace = options.explain
+
+	for index, result := range evaluator.EvaluateFormula(formula) {
+		name := result.Name
 		if name == "" {
-			name = humanize.Ordinal(index + 1)
+			name = humanize.Ordinal(formula.Equations[index].Ordinal)
 		}
 
-		fmt.Fprintf(&output, "\n**%v**: %v", discordEscapeMarkdown(name), equation.Term.Solve())
+		if len(result.Steps) > 0 {
+			writeSteps(&explanation, name, result.Steps)
+		}
+
+		if errors.Is(result.Err, context.DeadlineExceeded) || errors.Is(result.Err, context.Canceled) {
+			fmt.Fprintf(&output, "\n**%v**: **Error**: %v", discordEscapeMarkdown(name), rollTimeoutMessage)
+
+			continue
+		}
+
+		if result.Err != nil {
+			fmt.Fprintf(&output, "\n**%v**: **Error**: %v", discordEscapeMarkdown(name), discordEscapeMarkdown(result.Err.Error()))
+
+			var evaluationError *ast.EvaluationError
+			if errors.As(result.Err, &evaluationError) {
+				fmt.Fprintf(&output, "\n%v", discordCodeBlock(evaluationError.Span.Diagnostic(input)))
+			}
+
+			continue
+		}
+
+		fmt.Fprintf(&output, "\n**%v**: %v", discordEscapeMarkdown(name), bigValue(result.Value, result.Big))
+
+		if len(result.Subtotals) > 0 {
+			writeSubtotals(&output, result)
+		}
+
+		if len(result.Rolls) > 0 {
+			output.WriteString(" —")
+
+			for _, roll := range result.Rolls {
+				output.WriteByte(' ')
+				writeRoll(&output, roll)
+			}
+		}
+
+		if result.CriticalSuccess {
+			output.WriteString(" 🎉 **Critical success!**")
+		}
+
+		if result.CriticalFailure {
+			output.WriteString(" 💀 **Critical failure!**")
+		}
+	}
+
+	return fitMessage(output.String(), explanation.String())
+}
+
+// Fit a message and the explanation that follows it into one Discord message.
+// The explanation is cut short first, and left out when there is no room for
+// any of it. Messages that are too long by themselves are cut short too.
+func fitMessage(message, explanation string) string {
+	var output strings.Builder
+
+	room := discordMessageLimit - utf8.RuneCountInString(message)
+	if room < 0 {
+		// Lines are written after newlines, so the first needs one too.
+		writeTruncated(&output, "\n"+message, discordMessageLimit+1)
+
+		return strings.TrimPrefix(output.String(), "\n")
 	}
 
+	output.WriteString(message)
+	writeTruncated(&output, explanation, room)
+
 	return output.String()
 }
+
+// Write the steps taken to roll an equation as a numbered list.
+func writeSteps(output *strings.Builder, name string, steps []ast.Step) {
+	fmt.Fprintf(output, "\n**Steps for %v**:", discordEscapeMarkdown(name))
+
+	for index, step := range steps {
+		fmt.Fprintf(output, "\n%v. ", index+1)
+
+		if step.Roll != nil {
+			fmt.Fprintf(output, "%v ", discordEscapeMarkdown(step.Term.String()))
+			writeRoll(output, *step.Roll)
+		} else {
+			output.WriteString(discordEscapeMarkdown(step.Operation))
+		}
+
+		fmt.Fprintf(output, " → %v", discordEscapeMarkdown(step.Value))
+	}
+}
+
+// Write as many whole lines of text as fit in limit characters, noting how many
+// were left out, or nothing if not even the note fits. Each line of text starts
+// with a newline. Code blocks that are cut short are closed.
+func writeTruncated(output *strings.Builder, text string, limit int) {
+	if utf8.RuneCountInString(text) <= limit {
+		output.WriteString(text)
+
+		return
+	}
+
+	// Leave room for the note and for closing a code block.
+	limit -= len("\n```\n… 1000 more lines")
+	if limit < 0 {
+		return
+	}
+
+	lines := strings.Split(strings.TrimPrefix(text, "\n"), "\n")
+	inCodeBlock := false
+
+	for index, line := range lines {
+		limit -= 1 + utf8.RuneCountInString(line)
+		if limit < 0 {
+			if inCodeBlock {
+				output.WriteString("\n```")
+			}
+
+			fmt.Fprintf(output, "\n… %v more lines", len(lines)-index)
+
+			return
+		}
+
+		if strings.HasPrefix(line, "```") {
+			inCodeBlock = !inCodeBlock
+		}
+
+		output.WriteString("\n" + line)
+	}
+}
+
+// Write the dice of a roll like "\\[**20**, ~~1~~\\]", or "{9, 4}" for groups.
+// Critical dice are bold and dropped dice are struck through. Values of sampled
+// pools show how many dice rolled them, like "6 ×1,667,012".
+func writeRoll(output *strings.Builder, roll ast.Roll) {
+	// Keep long rolls from blowing past Discord's message size limit.
+	const maxDice = 20
+
+	if roll.Group {
+		output.WriteString("{")
+	} else {
+		output.WriteString("\\[")
+	}
+
+	for index, die := range roll.Dice {
+		if index > 0 {
+			output.WriteString(", ")
+		}
+
+		if index == maxDice {
+			fmt.Fprintf(output, "… %v more", len(roll.Dice)-maxDice)
+
+			break
+		}
+
+		value := fmt.Sprint(die.Value)
+		if die.Count > 0 {
+			value += " ×" + humanize.Comma(int64(die.Count))
+		}
+
+		switch {
+		case die.Dropped:
+			fmt.Fprintf(output, "~~%v~~", value)
+		case die.Critical != ast.NotCritical:
+			fmt.Fprintf(output, "**%v**", value)
+		default:
+			output.WriteString(value)
+		}
+	}
+
+	if roll.Group {
+		output.WriteString("}")
+	} else {
+		output.WriteString("\\]")
+	}
+}
+
+// Write the labelled parts of a result like " (12 slashing + 5 fire + 3)".
+func writeSubtotals(output *strings.Builder, result ast.Result) {
+	subtotals := append([]ast.Subtotal{}, result.Subtotals...)
+	unlabelled := bigValue(result.Value, result.Big)
+
+	for _, subtotal := range subtotals {
+		unlabelled.Sub(unlabelled, bigValue(subtotal.Value, subtotal.Big))
+	}
+
+	if unlabelled.Sign() != 0 {
+		subtotals = append(subtotals, ast.Subtotal{Label: "", Value: 0, Big: unlabelled})
+	}
+
+	output.WriteString(" (")
+
+	for index, subtotal := range subtotals {
+		value := bigValue(subtotal.Value, subtotal.Big)
+
+		switch {
+		case index == 0:
+		case value.Sign() < 0:
+			output.WriteString(" - ")
+
+			value.Neg(value)
+		default:
+			output.WriteString(" + ")
+		}
+
+		fmt.Fprintf(output, "%v", value)
+
+		if subtotal.Label != "" {
+			fmt.Fprintf(output, " %v", discordEscapeMarkdown(subtotal.Label))
+		}
+	}
+
+	output.WriteString(")")
+}
+
+// Return a value that may not fit in an int as a new *big.Int.
+func bigValue(value int, bigValue *big.Int) *big.Int {
+	if bigValue != nil {
+		return new(big.Int).Set(bigValue)
+	}
+
+	return big.NewInt(int64(value))
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollMessageLimit(t *testing.T) {
+	t.Parallel()
+
+	// Explanations are shown when there is room for them.
+	message := roll(context.Background(), "1d20 + 5", rollOptions{explain: true}) //nolint:exhaustruct
+	assert.Contains(t, message, "**Steps for 1st**:")
+
+	// Messages that are too long before the explanation is added leave it
+	// out and are cut short themselves.
+	message = roll(context.Background(), strings.Repeat("1d1, ", 60), rollOptions{explain: true}) //nolint:exhaustruct
+	assert.LessOrEqual(t, utf8.RuneCountInString(message), discordMessageLimit)
+	assert.NotContains(t, message, "**Steps for")
+	assert.Contains(t, message, "more lines")
+	assert.Zero(t, strings.Count(message, "```")%2, "code blocks should be closed")
+}